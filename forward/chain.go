@@ -0,0 +1,177 @@
+// Package forward builds chains of forward-go functions, generates the
+// equivalent OpenFaaS stack and invokes the head of the chain.
+package forward
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const (
+	// DefaultGateway is used when no gateway is set on the chain
+	DefaultGateway = "http://127.0.0.1:8080"
+	// Lang is the template used for every function in a chain
+	Lang = "forward-go"
+)
+
+// Step is a single function of a chain
+type Step struct {
+	// Name of the function, used as service name and forward address
+	Name string
+	// Image of the function, defaults to <registry>/<name>:latest
+	Image string
+	// Handler is the path of the function handler, defaults to ./<name>
+	Handler string
+	// Env are the user defined environment variables of the function
+	Env map[string]string
+	// ContentType of the function output, the template default is used
+	// if not set
+	ContentType string
+	// Async makes the step forward its output to the next step in async
+	Async bool
+}
+
+// FuncChain is an ordered list of functions where the output of each
+// function is forwarded as the input of the next one
+type FuncChain struct {
+	// Gateway is the address of the OpenFaaS gateway
+	Gateway string
+	// Registry is prefixed to the default image name of each step
+	Registry string
+	// Client is used to talk with the gateway
+	Client *http.Client
+
+	steps []*Step
+}
+
+// NewFuncChain creates an empty chain against the default gateway
+func NewFuncChain() *FuncChain {
+	return &FuncChain{
+		Gateway: DefaultGateway,
+		Client:  &http.Client{},
+	}
+}
+
+// Apply appends a function to the chain, the previous function forwards
+// its output to it in sync
+func (chain *FuncChain) Apply(name string, env map[string]string) *FuncChain {
+	chain.steps = append(chain.steps, &Step{Name: name, Env: env})
+	return chain
+}
+
+// AsyncApply appends a function to the chain, the previous function
+// forwards its output to it in async
+func (chain *FuncChain) AsyncApply(name string, env map[string]string) *FuncChain {
+	if len(chain.steps) > 0 {
+		chain.steps[len(chain.steps)-1].Async = true
+	}
+	return chain.Apply(name, env)
+}
+
+// Steps returns the steps of the chain in order, a step can be modified
+// before the chain is deployed
+func (chain *FuncChain) Steps() []*Step {
+	return chain.steps
+}
+
+// validate checks that the chain can be deployed
+func (chain *FuncChain) validate() error {
+	if len(chain.steps) == 0 {
+		return fmt.Errorf("chain has no function")
+	}
+	names := make(map[string]bool)
+	for _, step := range chain.steps {
+		if step.Name == "" {
+			return fmt.Errorf("chain has a function without name")
+		}
+		if names[step.Name] {
+			return fmt.Errorf("function '%s' is applied more than once", step.Name)
+		}
+		names[step.Name] = true
+	}
+	return nil
+}
+
+// gateway returns the gateway address without trailing slash
+func (chain *FuncChain) gateway() string {
+	if chain.Gateway == "" {
+		return DefaultGateway
+	}
+	return strings.TrimRight(chain.Gateway, "/")
+}
+
+// client returns the http client used to talk with the gateway
+func (chain *FuncChain) client() *http.Client {
+	if chain.Client == nil {
+		return http.DefaultClient
+	}
+	return chain.Client
+}
+
+// image returns the image of the step
+func (chain *FuncChain) image(step *Step) string {
+	if step.Image != "" {
+		return step.Image
+	}
+	if chain.Registry != "" {
+		return strings.TrimRight(chain.Registry, "/") + "/" + step.Name + ":latest"
+	}
+	return step.Name + ":latest"
+}
+
+// environment returns the env of the step at index as expected by the
+// forward-go template
+func (chain *FuncChain) environment(index int) map[string]string {
+	step := chain.steps[index]
+	env := make(map[string]string)
+	for key, value := range step.Env {
+		env[key] = value
+	}
+
+	// The head of the chain handles a POST request, others a forwarded file
+	if index == 0 {
+		env["input_type"] = "POST"
+	} else {
+		env["input_type"] = "FILE"
+	}
+
+	if step.ContentType != "" {
+		env["content_type"] = step.ContentType
+	}
+
+	// No forward defines the end of a chain
+	delete(env, "forward")
+	delete(env, "async")
+	if index < len(chain.steps)-1 {
+		env["forward"] = chain.steps[index+1].Name
+		if step.Async {
+			env["async"] = "true"
+		} else {
+			env["async"] = "false"
+		}
+	}
+	return env
+}
+
+// Invoke executes the chain with data as the input of the head function
+// and returns the output of the chain, if a function forwards in async the
+// output is its 202 reply, a JSON body with the request_id to query on its
+// /_/status/<request_id> endpoint
+func (chain *FuncChain) Invoke(data io.Reader) (io.ReadCloser, error) {
+	err := chain.validate()
+	if err != nil {
+		return nil, err
+	}
+	url := chain.gateway() + "/function/" + chain.steps[0].Name
+	resp, err := chain.client().Post(url, "application/octet-stream", data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to invoke %s, error %v", url, err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		return nil, fmt.Errorf("failed to invoke %s, error %s", url, readError(resp))
+	}
+	return resp.Body, nil
+}
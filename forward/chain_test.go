@@ -0,0 +1,173 @@
+package forward
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestStack(t *testing.T) {
+	chain := NewFuncChain().
+		Apply("resize", map[string]string{"forward": "ignored", "scale": "2"}).
+		AsyncApply("upload", nil)
+	chain.Gateway = "http://gateway:8080/"
+	chain.Registry = "registry.local/"
+	chain.Steps()[1].ContentType = "image/png"
+
+	stack, err := chain.Stack()
+	if err != nil {
+		t.Fatalf("failed to generate stack, error: %v", err)
+	}
+	expected := `provider:
+  name: faas
+  gateway: "http://gateway:8080"
+
+functions:
+  resize:
+    lang: forward-go
+    handler: "./resize"
+    image: "registry.local/resize:latest"
+    environment:
+      async: "true"
+      forward: "upload"
+      input_type: "POST"
+      scale: "2"
+
+  upload:
+    lang: forward-go
+    handler: "./upload"
+    image: "registry.local/upload:latest"
+    environment:
+      content_type: "image/png"
+      input_type: "FILE"
+`
+	if string(stack) != expected {
+		t.Errorf("unexpected stack:\n%s\nexpected:\n%s", stack, expected)
+	}
+}
+
+func TestStackInvalidChain(t *testing.T) {
+	if _, err := NewFuncChain().Stack(); err == nil {
+		t.Error("expected an error for an empty chain")
+	}
+	chain := NewFuncChain().Apply("resize", nil).Apply("resize", nil)
+	if _, err := chain.Stack(); err == nil {
+		t.Error("expected an error for a function applied twice")
+	}
+}
+
+func TestDeploy(t *testing.T) {
+	var lock sync.Mutex
+	var calls []string
+	deployed := make(map[string]*deployment)
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/system/functions" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		spec := &deployment{}
+		if err := json.NewDecoder(r.Body).Decode(spec); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		calls = append(calls, r.Method+" "+spec.Service)
+		_, exists := deployed[spec.Service]
+		switch {
+		case r.Method == http.MethodPut && !exists:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		case r.Method == http.MethodPost && exists:
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		deployed[spec.Service] = spec
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer gateway.Close()
+
+	// the first function exists and is updated, the second one is created
+	deployed["resize"] = &deployment{Service: "resize"}
+	chain := NewFuncChain().Apply("resize", nil).Apply("upload", nil)
+	chain.Gateway = gateway.URL
+	if err := chain.Deploy(); err != nil {
+		t.Fatalf("failed to deploy chain, error: %v", err)
+	}
+
+	expected := []string{"PUT resize", "PUT upload", "POST upload"}
+	if strings.Join(calls, ",") != strings.Join(expected, ",") {
+		t.Errorf("unexpected calls %v, expected %v", calls, expected)
+	}
+	upload := deployed["upload"]
+	if upload.Image != "upload:latest" || upload.EnvProcess != fprocess {
+		t.Errorf("unexpected deployment %+v", upload)
+	}
+	if upload.EnvVars["input_type"] != "FILE" || upload.EnvVars["forward"] != "" {
+		t.Errorf("unexpected env of the end of chain %v", upload.EnvVars)
+	}
+	if deployed["resize"].EnvVars["forward"] != "upload" || deployed["resize"].EnvVars["async"] != "false" {
+		t.Errorf("unexpected env of the head of chain %v", deployed["resize"].EnvVars)
+	}
+}
+
+func TestDeployFailure(t *testing.T) {
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("no capacity"))
+	}))
+	defer gateway.Close()
+
+	chain := NewFuncChain().Apply("resize", nil)
+	chain.Gateway = gateway.URL
+	err := chain.Deploy()
+	if err == nil || !strings.Contains(err.Error(), "no capacity") {
+		t.Errorf("expected the gateway error, got %v", err)
+	}
+}
+
+func TestInvoke(t *testing.T) {
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/function/resize" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write([]byte("resized " + string(body)))
+	}))
+	defer gateway.Close()
+
+	chain := NewFuncChain().Apply("resize", nil).Apply("upload", nil)
+	chain.Gateway = gateway.URL
+	result, err := chain.Invoke(strings.NewReader("image"))
+	if err != nil {
+		t.Fatalf("failed to invoke chain, error: %v", err)
+	}
+	defer result.Close()
+	body, err := ioutil.ReadAll(result)
+	if err != nil {
+		t.Fatalf("failed to read result, error: %v", err)
+	}
+	if string(body) != "resized image" {
+		t.Errorf("unexpected result '%s'", body)
+	}
+}
+
+func TestInvokeFailure(t *testing.T) {
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte("function failed"))
+	}))
+	defer gateway.Close()
+
+	chain := NewFuncChain().Apply("resize", nil)
+	chain.Gateway = gateway.URL
+	_, err := chain.Invoke(strings.NewReader("image"))
+	if err == nil || !strings.Contains(err.Error(), "function failed") {
+		t.Errorf("expected the function error, got %v", err)
+	}
+}
@@ -0,0 +1,91 @@
+package forward
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// fprocess of the forward-go template
+const fprocess = "./handler"
+
+// deployment is the function deployment request of the gateway
+type deployment struct {
+	Service    string            `json:"service"`
+	Image      string            `json:"image"`
+	EnvProcess string            `json:"envProcess"`
+	EnvVars    map[string]string `json:"envVars"`
+}
+
+// Deploy creates or updates every function of the chain on the gateway,
+// the function images must already be built and available
+func (chain *FuncChain) Deploy() error {
+	err := chain.validate()
+	if err != nil {
+		return err
+	}
+	for index, step := range chain.steps {
+		spec := deployment{
+			Service:    step.Name,
+			Image:      chain.image(step),
+			EnvProcess: fprocess,
+			EnvVars:    chain.environment(index),
+		}
+		err = chain.deploy(&spec)
+		if err != nil {
+			return fmt.Errorf("failed to deploy function '%s', error %v", step.Name, err)
+		}
+	}
+	return nil
+}
+
+// deploy updates the function and creates it if it doesn't exist
+func (chain *FuncChain) deploy(spec *deployment) error {
+	body, err := json.Marshal(spec)
+	if err != nil {
+		return err
+	}
+	url := chain.gateway() + "/system/functions"
+
+	status, err := chain.request(http.MethodPut, url, body)
+	if err != nil {
+		return err
+	}
+	if status == http.StatusNotFound {
+		_, err = chain.request(http.MethodPost, url, body)
+	}
+	return err
+}
+
+// request performs a request on the gateway and returns the status code,
+// an error is returned for any unexpected status
+func (chain *FuncChain) request(method string, url string, body []byte) (int, error) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := chain.client().Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode <= 299:
+		return resp.StatusCode, nil
+	case resp.StatusCode == http.StatusNotFound && method == http.MethodPut:
+		return resp.StatusCode, nil
+	}
+	return resp.StatusCode, fmt.Errorf("%s %s, %s", method, url, readError(resp))
+}
+
+// readError returns the status and the body of a failed response
+func readError(resp *http.Response) string {
+	body, _ := ioutil.ReadAll(resp.Body)
+	if len(body) == 0 {
+		return "bad status: " + resp.Status
+	}
+	return fmt.Sprintf("bad status: %s, %s", resp.Status, bytes.TrimSpace(body))
+}
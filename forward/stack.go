@@ -0,0 +1,68 @@
+package forward
+
+import (
+	"bytes"
+	"io"
+	"sort"
+	"strconv"
+)
+
+// Stack returns the OpenFaaS stack definition (stack.yml) equivalent to
+// the chain
+func (chain *FuncChain) Stack() ([]byte, error) {
+	var b bytes.Buffer
+	_, err := chain.WriteStack(&b)
+	if err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// WriteStack writes the OpenFaaS stack definition of the chain to w
+func (chain *FuncChain) WriteStack(w io.Writer) (int64, error) {
+	err := chain.validate()
+	if err != nil {
+		return 0, err
+	}
+
+	var b bytes.Buffer
+	b.WriteString("provider:\n")
+	b.WriteString("  name: faas\n")
+	b.WriteString("  gateway: " + quote(chain.gateway()) + "\n")
+	b.WriteString("\n")
+	b.WriteString("functions:\n")
+	for index, step := range chain.steps {
+		handler := step.Handler
+		if handler == "" {
+			handler = "./" + step.Name
+		}
+		b.WriteString("  " + step.Name + ":\n")
+		b.WriteString("    lang: " + Lang + "\n")
+		b.WriteString("    handler: " + quote(handler) + "\n")
+		b.WriteString("    image: " + quote(chain.image(step)) + "\n")
+		b.WriteString("    environment:\n")
+		env := chain.environment(index)
+		for _, key := range sortedKeys(env) {
+			b.WriteString("      " + key + ": " + quote(env[key]) + "\n")
+		}
+		if index < len(chain.steps)-1 {
+			b.WriteString("\n")
+		}
+	}
+	return b.WriteTo(w)
+}
+
+// quote returns value as a yaml double quoted string
+func quote(value string) string {
+	return strconv.Quote(value)
+}
+
+// sortedKeys returns the keys of env in a stable order
+func sortedKeys(env map[string]string) []string {
+	keys := make([]string, 0, len(env))
+	for key := range env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
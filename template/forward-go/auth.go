@@ -0,0 +1,482 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// header carrying the verified identity claims of the caller of the
+	// chain as base64url encoded json
+	identityHeader = "X-Forward-Identity"
+	// leeway on the expiry and not-before times of a JWT for clock skew
+	jwtLeeway = 30 * time.Second
+)
+
+var (
+	// static bearer tokens accepted at the head of the chain
+	authTokens []*staticToken
+	// static basic credentials accepted at the head of the chain, by user
+	authUsers map[string]string
+	// keys the JWTs accepted at the head of the chain are signed with
+	authKeys []*jwk
+	// issuer, audience and claims a JWT must carry
+	jwtIssuer   string
+	jwtAudience string
+	jwtClaims   map[string]string
+)
+
+// staticToken is a bearer token and the subject it identifies
+type staticToken struct {
+	subject string
+	token   string
+}
+
+// jwk is a public key of a JWKS
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+
+	key crypto.PublicKey
+}
+
+// jwtAlg is a supported JWT signing algorithm
+type jwtAlg struct {
+	kty  string
+	crv  string
+	hash crypto.Hash
+}
+
+var jwtAlgs = map[string]jwtAlg{
+	"RS256": {kty: "RSA", hash: crypto.SHA256},
+	"RS384": {kty: "RSA", hash: crypto.SHA384},
+	"RS512": {kty: "RSA", hash: crypto.SHA512},
+	"ES256": {kty: "EC", crv: "P-256", hash: crypto.SHA256},
+	"ES384": {kty: "EC", crv: "P-384", hash: crypto.SHA384},
+	"ES512": {kty: "EC", crv: "P-521", hash: crypto.SHA512},
+}
+
+// identityKey is the context key of the identity of the caller
+type identityKey struct{}
+
+// parseAuth reads the entry authentication of the function
+func parseAuth() {
+	if val := os.Getenv("auth_tokens_file"); val != "" {
+		for _, line := range readSecretLines(val) {
+			subject, token, ok := splitCredential(line)
+			if !ok {
+				logger.Warn("ignoring invalid line in auth_tokens_file, expecting 'subject:token'")
+				continue
+			}
+			authTokens = append(authTokens, &staticToken{subject: subject, token: token})
+		}
+	}
+	if val := os.Getenv("auth_basic_file"); val != "" {
+		authUsers = make(map[string]string)
+		for _, line := range readSecretLines(val) {
+			user, password, ok := splitCredential(line)
+			if !ok {
+				logger.Warn("ignoring invalid line in auth_basic_file, expecting 'user:password'")
+				continue
+			}
+			authUsers[user] = password
+		}
+	}
+	if val := os.Getenv("auth_jwks_file"); val != "" {
+		path := secretPath(val)
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			logger.Panic("Cannot read auth_jwks_file", "path", path, "error", err)
+		}
+		authKeys, err = parseJWKS(content)
+		if err != nil {
+			logger.Panic("Cannot parse auth_jwks_file", "path", path, "error", err)
+		}
+		jwtIssuer = os.Getenv("auth_jwt_issuer")
+		jwtAudience = os.Getenv("auth_jwt_audience")
+		jwtClaims = parseClaimList(os.Getenv("auth_jwt_claims"))
+	}
+	if !authEnabled() {
+		return
+	}
+	if inputType != "POST" {
+		logger.Warn("Entry authentication is only applied with input_type POST, only the dead letter replay is authenticated")
+		return
+	}
+	logger.Info("Entry authentication enabled, callers must provide credentials",
+		"tokens", len(authTokens), "users", len(authUsers), "jwt_keys", len(authKeys))
+	if !signingEnabled() {
+		logger.Warn("Entry authentication enabled without forward_secret, the identity of the caller is NOT forwarded " +
+			"to the next functions as it can't be signed, set forward_secret on every function of the chain")
+	}
+}
+
+// readSecretLines reads the non empty lines of a secret, lines starting
+// with '#' are ignored
+func readSecretLines(val string) []string {
+	path := secretPath(val)
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		logger.Panic("Cannot read authentication file", "path", path, "error", err)
+	}
+	var lines []string
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// splitCredential splits a 'name:secret' line at the first ':', the name
+// can't contain ':' while the secret can
+func splitCredential(line string) (string, string, bool) {
+	i := strings.Index(line, ":")
+	if i <= 0 || i == len(line)-1 {
+		return "", "", false
+	}
+	return line[:i], line[i+1:], true
+}
+
+// parseClaimList parses a comma separated list of 'claim=value'
+func parseClaimList(val string) map[string]string {
+	claims := make(map[string]string)
+	for _, pair := range strings.Split(val, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		i := strings.Index(pair, "=")
+		if i <= 0 {
+			logger.Warn("ignoring invalid claim in auth_jwt_claims, expecting 'claim=value'", "claim", pair)
+			continue
+		}
+		claims[strings.TrimSpace(pair[:i])] = strings.TrimSpace(pair[i+1:])
+	}
+	return claims
+}
+
+// parseJWKS parses the public keys of a JWKS, keys of an unsupported type
+// are ignored
+func parseJWKS(content []byte) ([]*jwk, error) {
+	var set struct {
+		Keys []*jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(content, &set); err != nil {
+		return nil, err
+	}
+	var keys []*jwk
+	for _, k := range set.Keys {
+		var err error
+		switch k.Kty {
+		case "RSA":
+			k.key, err = k.rsaKey()
+		case "EC":
+			k.key, err = k.ecKey()
+		default:
+			logger.Warn("ignoring JWK of unsupported type", "kid", k.Kid, "kty", k.Kty)
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid key '%s', error: %v", k.Kid, err)
+		}
+		keys = append(keys, k)
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no supported key found")
+	}
+	return keys, nil
+}
+
+func (k *jwk) rsaKey() (*rsa.PublicKey, error) {
+	n, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil {
+		return nil, err
+	}
+	e, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil {
+		return nil, err
+	}
+	exponent := new(big.Int).SetBytes(e)
+	if !exponent.IsInt64() || exponent.Int64() < 3 || exponent.Int64() > 1<<31-1 {
+		return nil, errors.New("invalid exponent")
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+}
+
+func (k *jwk) ecKey() (*ecdsa.PublicKey, error) {
+	var curve elliptic.Curve
+	switch k.Crv {
+	case "P-256":
+		curve = elliptic.P256()
+	case "P-384":
+		curve = elliptic.P384()
+	case "P-521":
+		curve = elliptic.P521()
+	default:
+		return nil, fmt.Errorf("unsupported curve '%s'", k.Crv)
+	}
+	x, err := base64.RawURLEncoding.DecodeString(k.X)
+	if err != nil {
+		return nil, err
+	}
+	y, err := base64.RawURLEncoding.DecodeString(k.Y)
+	if err != nil {
+		return nil, err
+	}
+	key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+	if !curve.IsOnCurve(key.X, key.Y) {
+		return nil, errors.New("point not on curve")
+	}
+	return key, nil
+}
+
+// verify checks the signature of the signed part of a JWT
+func (k *jwk) verify(alg string, signed []byte, sig []byte) bool {
+	a, ok := jwtAlgs[alg]
+	if !ok || a.kty != k.Kty || (k.Alg != "" && k.Alg != alg) {
+		return false
+	}
+	h := a.hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+	switch key := k.key.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, a.hash, digest, sig) == nil
+	case *ecdsa.PublicKey:
+		if key.Curve.Params().Name != a.crv {
+			return false
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		return ecdsa.Verify(key, digest, r, s)
+	}
+	return false
+}
+
+// authEnabled checks if the callers of the chain are authenticated
+func authEnabled() bool {
+	return len(authTokens) > 0 || authUsers != nil || len(authKeys) > 0
+}
+
+// authenticate verifies the credentials of the caller of the chain and
+// returns its identity claims
+func authenticate(r *http.Request) (map[string]interface{}, error) {
+	auth := r.Header.Get("Authorization")
+	if auth == "" {
+		return nil, errors.New("missing credentials")
+	}
+	scheme, credentials := auth, ""
+	if i := strings.Index(auth, " "); i >= 0 {
+		scheme, credentials = auth[:i], strings.TrimSpace(auth[i+1:])
+	}
+	switch strings.ToLower(scheme) {
+	case "bearer":
+		for _, t := range authTokens {
+			if subtle.ConstantTimeCompare([]byte(credentials), []byte(t.token)) == 1 {
+				return subjectClaims(t.subject), nil
+			}
+		}
+		if len(authKeys) > 0 {
+			return verifyJWT(credentials)
+		}
+		return nil, errors.New("invalid token")
+	case "basic":
+		user, password, ok := r.BasicAuth()
+		expected, found := authUsers[user]
+		if !ok || !found || subtle.ConstantTimeCompare([]byte(password), []byte(expected)) != 1 {
+			return nil, errors.New("invalid credentials")
+		}
+		return subjectClaims(user), nil
+	}
+	return nil, fmt.Errorf("unsupported authorization scheme '%s'", scheme)
+}
+
+// subjectClaims returns the identity claims of a static credential
+func subjectClaims(subject string) map[string]interface{} {
+	return map[string]interface{}{"sub": subject}
+}
+
+// verifyJWT verifies the signature and the claims of a JWT and returns
+// its claims
+func verifyJWT(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("malformed token header, error: %v", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token signature, error: %v", err)
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	verified := false
+	for _, k := range authKeys {
+		if header.Kid != "" && k.Kid != header.Kid {
+			continue
+		}
+		if k.verify(header.Alg, signed, sig) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, errors.New("invalid token signature")
+	}
+
+	claims := make(map[string]interface{})
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("malformed token claims, error: %v", err)
+	}
+	now := time.Now()
+	exp, ok := timeClaim(claims, "exp")
+	if !ok {
+		return nil, errors.New("token has no expiry")
+	}
+	if now.After(exp.Add(jwtLeeway)) {
+		return nil, errors.New("token expired")
+	}
+	if nbf, ok := timeClaim(claims, "nbf"); ok && now.Before(nbf.Add(-jwtLeeway)) {
+		return nil, errors.New("token not valid yet")
+	}
+	if jwtIssuer != "" && claims["iss"] != jwtIssuer {
+		return nil, errors.New("invalid token issuer")
+	}
+	if jwtAudience != "" && !claimMatches(claims["aud"], jwtAudience) {
+		return nil, errors.New("invalid token audience")
+	}
+	for name, want := range jwtClaims {
+		if !claimMatches(claims[name], want) {
+			return nil, fmt.Errorf("token claim '%s' doesn't match", name)
+		}
+	}
+	return claims, nil
+}
+
+// decodeSegment decodes a base64url json segment of a JWT
+func decodeSegment(segment string, v interface{}) error {
+	content, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(content, v)
+}
+
+// timeClaim returns a claim in seconds since epoch as a time
+func timeClaim(claims map[string]interface{}, name string) (time.Time, bool) {
+	seconds, ok := claims[name].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(seconds), 0), true
+}
+
+// claimMatches checks if a claim has the value, a list claim matches if
+// one of its values does and a string claim matches if one of its space
+// separated values does, as for the 'scope' claim
+func claimMatches(claim interface{}, want string) bool {
+	switch value := claim.(type) {
+	case nil:
+		return false
+	case string:
+		for _, field := range strings.Fields(value) {
+			if field == want {
+				return true
+			}
+		}
+		return value == want
+	case []interface{}:
+		for _, item := range value {
+			if claimMatches(item, want) {
+				return true
+			}
+		}
+		return false
+	}
+	return fmt.Sprint(claim) == want
+}
+
+// rejectUnauthenticated replies 401 to a caller of the chain that doesn't
+// provide valid credentials, the identity of an authenticated caller is
+// added to the request context
+func rejectUnauthenticated(w http.ResponseWriter, r *http.Request) (*http.Request, bool) {
+	if !authEnabled() || inputType != "POST" {
+		return r, false
+	}
+	claims, err := authenticate(r)
+	if err == nil {
+		return r.WithContext(context.WithValue(r.Context(), identityKey{}, claims)), false
+	}
+	meta := newMeta(r, "")
+	requestLogger(meta).Warn("rejecting request", "remote", r.RemoteAddr, "error", err)
+	if len(authTokens) > 0 || len(authKeys) > 0 {
+		w.Header().Add("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s"`, functionName))
+	}
+	if authUsers != nil {
+		w.Header().Add("WWW-Authenticate", fmt.Sprintf(`Basic realm="%s"`, functionName))
+	}
+	writeError(w, meta, http.StatusUnauthorized, err.Error())
+	return r, true
+}
+
+// identityOf returns the identity of the authenticated caller of a request
+func identityOf(r *http.Request) map[string]interface{} {
+	claims, _ := r.Context().Value(identityKey{}).(map[string]interface{})
+	return claims
+}
+
+// encodeIdentity encodes identity claims as the identity header value
+func encodeIdentity(claims map[string]interface{}) string {
+	content, err := json.Marshal(claims)
+	if err != nil {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(content)
+}
+
+// decodeIdentity decodes the identity claims of the identity header value,
+// nil is returned for an invalid value
+func decodeIdentity(val string) map[string]interface{} {
+	if val == "" {
+		return nil
+	}
+	claims := make(map[string]interface{})
+	if decodeSegment(val, &claims) != nil {
+		return nil
+	}
+	return claims
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testKeys are the keys of the JWTs of a test, published in a JWKS
+type testKeys struct {
+	rsa *rsa.PrivateKey
+	ec  *ecdsa.PrivateKey
+}
+
+func newTestKeys(t *testing.T) *testKeys {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("failed to generate rsa key, error: %v", err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate ec key, error: %v", err)
+	}
+	return &testKeys{rsa: rsaKey, ec: ecKey}
+}
+
+// jwks returns the JWKS of the public keys
+func (k *testKeys) jwks() []byte {
+	encode := base64.RawURLEncoding.EncodeToString
+	set := map[string]interface{}{"keys": []map[string]string{
+		{"kty": "RSA", "kid": "rsa", "n": encode(k.rsa.N.Bytes()), "e": encode(big.NewInt(int64(k.rsa.E)).Bytes())},
+		{"kty": "EC", "kid": "ec", "crv": "P-256", "x": encode(k.ec.X.Bytes()), "y": encode(k.ec.Y.Bytes())},
+		{"kty": "oct", "kid": "hmac", "k": encode([]byte("secret"))},
+	}}
+	content, _ := json.Marshal(set)
+	return content
+}
+
+// sign returns a JWT of the header and claims signed as per its alg
+func (k *testKeys) sign(t *testing.T, header map[string]interface{}, claims map[string]interface{}) string {
+	encode := func(v interface{}) string {
+		content, _ := json.Marshal(v)
+		return base64.RawURLEncoding.EncodeToString(content)
+	}
+	signed := encode(header) + "." + encode(claims)
+	digest := sha256.Sum256([]byte(signed))
+	var sig []byte
+	switch header["alg"] {
+	case "RS256":
+		var err error
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k.rsa, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatalf("failed to sign token, error: %v", err)
+		}
+	case "ES256":
+		r, s, err := ecdsa.Sign(rand.Reader, k.ec, digest[:])
+		if err != nil {
+			t.Fatalf("failed to sign token, error: %v", err)
+		}
+		sig = make([]byte, 64)
+		rb, sb := r.Bytes(), s.Bytes()
+		copy(sig[32-len(rb):], rb)
+		copy(sig[64-len(sb):], sb)
+	case "HS256":
+		// signed with the public RSA modulus as the HMAC key
+		mac := hmac.New(sha256.New, k.rsa.N.Bytes())
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// setupAuth resets the entry authentication, the returned function
+// restores it
+func setupAuth() func() {
+	saved := []interface{}{authTokens, authUsers, authKeys, jwtIssuer, jwtAudience, jwtClaims, inputType}
+	authTokens, authUsers, authKeys = nil, nil, nil
+	jwtIssuer, jwtAudience, jwtClaims = "", "", nil
+	inputType = "POST"
+	return func() {
+		authTokens = saved[0].([]*staticToken)
+		authUsers = saved[1].(map[string]string)
+		authKeys = saved[2].([]*jwk)
+		jwtIssuer, jwtAudience = saved[3].(string), saved[4].(string)
+		jwtClaims = saved[5].(map[string]string)
+		inputType = saved[6].(string)
+	}
+}
+
+func TestVerifyJWT(t *testing.T) {
+	defer setupAuth()()
+	keys := newTestKeys(t)
+	var err error
+	authKeys, err = parseJWKS(keys.jwks())
+	if err != nil {
+		t.Fatalf("failed to parse jwks, error: %v", err)
+	}
+	if len(authKeys) != 2 {
+		t.Fatalf("expected the unsupported key to be ignored, got %d keys", len(authKeys))
+	}
+	jwtIssuer, jwtAudience = "https://idp.example.com/", "orders"
+	jwtClaims = map[string]string{"scope": "orders:write"}
+
+	now := time.Now().Unix()
+	valid := func() map[string]interface{} {
+		return map[string]interface{}{
+			"sub":   "alice",
+			"iss":   "https://idp.example.com/",
+			"aud":   []string{"billing", "orders"},
+			"scope": "openid orders:write",
+			"exp":   now + 60,
+		}
+	}
+	with := func(name string, value interface{}) map[string]interface{} {
+		claims := valid()
+		if value == nil {
+			delete(claims, name)
+		} else {
+			claims[name] = value
+		}
+		return claims
+	}
+	rs256 := map[string]interface{}{"alg": "RS256", "kid": "rsa"}
+	es256 := map[string]interface{}{"alg": "ES256", "kid": "ec"}
+
+	for _, tc := range []struct {
+		name   string
+		token  string
+		verify bool
+	}{
+		{"rs256", keys.sign(t, rs256, valid()), true},
+		{"es256", keys.sign(t, es256, valid()), true},
+		{"no kid", keys.sign(t, map[string]interface{}{"alg": "ES256"}, valid()), true},
+		{"alg none", keys.sign(t, map[string]interface{}{"alg": "none", "kid": "rsa"}, valid()), false},
+		{"hs256 against rsa key", keys.sign(t, map[string]interface{}{"alg": "HS256", "kid": "rsa"}, valid()), false},
+		{"hs256 against hmac key", keys.sign(t, map[string]interface{}{"alg": "HS256", "kid": "hmac"}, valid()), false},
+		{"unknown kid", keys.sign(t, map[string]interface{}{"alg": "RS256", "kid": "other"}, valid()), false},
+		{"alg of another kty", keys.sign(t, map[string]interface{}{"alg": "ES256", "kid": "rsa"}, valid()), false},
+		{"kty of another alg", keys.sign(t, map[string]interface{}{"alg": "RS256", "kid": "ec"}, valid()), false},
+		{"tampered claims", strings.Replace(keys.sign(t, rs256, valid()), ".", ".e30", 1), false},
+		{"malformed", "not-a-token", false},
+		{"no expiry", keys.sign(t, rs256, with("exp", nil)), false},
+		{"expired within leeway", keys.sign(t, rs256, with("exp", now-10)), true},
+		{"expired", keys.sign(t, rs256, with("exp", now-60)), false},
+		{"not valid yet within leeway", keys.sign(t, rs256, with("nbf", now+10)), true},
+		{"not valid yet", keys.sign(t, rs256, with("nbf", now+60)), false},
+		{"other issuer", keys.sign(t, rs256, with("iss", "https://other.example.com/")), false},
+		{"audience string", keys.sign(t, rs256, with("aud", "orders")), true},
+		{"other audience", keys.sign(t, rs256, with("aud", "billing")), false},
+		{"no audience", keys.sign(t, rs256, with("aud", nil)), false},
+		{"scope list", keys.sign(t, rs256, with("scope", []string{"orders:write"})), true},
+		{"missing scope", keys.sign(t, rs256, with("scope", "openid")), false},
+		{"no scope", keys.sign(t, rs256, with("scope", nil)), false},
+	} {
+		claims, err := verifyJWT(tc.token)
+		if tc.verify && (err != nil || claims["sub"] != "alice") {
+			t.Errorf("%s: expected the token to be verified, error: %v", tc.name, err)
+		}
+		if !tc.verify && err == nil {
+			t.Errorf("%s: expected the token to be rejected", tc.name)
+		}
+	}
+
+	// a key restricted to an alg doesn't verify another one
+	authKeys[0].Alg = "RS384"
+	if _, err := verifyJWT(keys.sign(t, rs256, valid())); err == nil {
+		t.Error("expected the alg of the key to be enforced")
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	defer setupAuth()()
+	dir, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatalf("failed to create directory, error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	tokens := filepath.Join(dir, "tokens")
+	basic := filepath.Join(dir, "basic")
+	ioutil.WriteFile(tokens, []byte("# static tokens\nci:tok:with:colons\nno-subject\n\n"), 0600)
+	ioutil.WriteFile(basic, []byte("alice:pass:word\ninvalid\n"), 0600)
+	os.Setenv("auth_tokens_file", tokens)
+	os.Setenv("auth_basic_file", basic)
+	defer os.Unsetenv("auth_tokens_file")
+	defer os.Unsetenv("auth_basic_file")
+	parseAuth()
+
+	if len(authTokens) != 1 || authTokens[0].subject != "ci" || authTokens[0].token != "tok:with:colons" {
+		t.Fatalf("unexpected tokens %+v", authTokens)
+	}
+	if len(authUsers) != 1 || authUsers["alice"] != "pass:word" {
+		t.Fatalf("unexpected users %v", authUsers)
+	}
+
+	request := func(auth string) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "/", nil)
+		if auth != "" {
+			r.Header.Set("Authorization", auth)
+		}
+		return r
+	}
+	basicAuth := func(user string, password string) string {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password))
+	}
+	for _, tc := range []struct {
+		auth    string
+		subject string
+	}{
+		{"Bearer tok:with:colons", "ci"},
+		{"bearer tok:with:colons", "ci"},
+		{basicAuth("alice", "pass:word"), "alice"},
+		{"Bearer tok", ""},
+		{"Bearer no-subject", ""},
+		{"Bearer ci:tok:with:colons", ""},
+		{basicAuth("alice", "pass"), ""},
+		{basicAuth("bob", "pass:word"), ""},
+		{"Digest tok:with:colons", ""},
+		{"", ""},
+	} {
+		claims, err := authenticate(request(tc.auth))
+		if tc.subject != "" && (err != nil || claims["sub"] != tc.subject) {
+			t.Errorf("'%s': expected subject '%s', error: %v", tc.auth, tc.subject, err)
+		}
+		if tc.subject == "" && err == nil {
+			t.Errorf("'%s': expected the credentials to be rejected", tc.auth)
+		}
+	}
+}
+
+func TestRejectUnauthenticated(t *testing.T) {
+	defer setupAuth()()
+	authTokens = []*staticToken{{subject: "ci", token: "secret-token"}}
+	authUsers = map[string]string{"alice": "password"}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/", nil)
+	r.Header.Set("Authorization", "Bearer wrong")
+	if _, rejected := rejectUnauthenticated(w, r); !rejected {
+		t.Fatal("expected the request to be rejected")
+	}
+	if w.Code != http.StatusUnauthorized || w.Header().Get(chainErrorHeader) != "0" {
+		t.Errorf("unexpected reply %d, chain error '%s'", w.Code, w.Header().Get(chainErrorHeader))
+	}
+	challenges := w.HeaderMap["Www-Authenticate"]
+	if len(challenges) != 2 || !strings.HasPrefix(challenges[0], "Bearer ") || !strings.HasPrefix(challenges[1], "Basic ") {
+		t.Errorf("unexpected challenges %v", challenges)
+	}
+	envelope := &errorEnvelope{}
+	if err := json.Unmarshal(w.Body.Bytes(), envelope); err != nil || envelope.Error == nil {
+		t.Fatalf("expected the error envelope, error: %v", err)
+	}
+	if envelope.Error.Status != http.StatusUnauthorized || envelope.Error.Message != "invalid token" || envelope.Error.Hop != 0 {
+		t.Errorf("unexpected chain error %+v", envelope.Error)
+	}
+
+	// the identity of an authenticated caller is kept with the request
+	w = httptest.NewRecorder()
+	r.Header.Set("Authorization", "Bearer secret-token")
+	r, rejected := rejectUnauthenticated(w, r)
+	if rejected || identityOf(r)["sub"] != "ci" {
+		t.Errorf("expected the caller to be authenticated, identity %v", identityOf(r))
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// header of the caller providing the callback URL of the chain
+	callbackHeader = "X-Callback-Url"
+	// header carrying the callback URL along the chain
+	forwardCallbackHeader = "X-Forward-Callback-Url"
+	// header marking a request that went through an async function
+	asyncHeader = "X-Forward-Async"
+	// header carrying the status of the result to the callback
+	callbackStatusHeader = "X-Function-Status"
+	// header carrying the error of the failed function to the callback
+	callbackErrorHeader = "X-Forward-Error"
+)
+
+var (
+	// callbackURL is the callback URL used when the caller provides none
+	callbackURL string
+)
+
+// needsCallback checks if the result of a request is sent to the callback,
+// the caller of an async chain doesn't wait for the result
+func needsCallback(meta *requestMeta) bool {
+	return meta.Async && meta.CallbackURL != ""
+}
+
+// postCallback sends a result to the callback URL of the request
+func postCallback(meta *requestMeta, body io.Reader, respType string, status int, errMsg string) error {
+	req, err := http.NewRequest(http.MethodPost, meta.CallbackURL, body)
+	if err != nil {
+		return err
+	}
+	if respType != "" {
+		req.Header.Set("Content-Type", respType)
+	}
+	req.Header.Set(requestIDHeader, meta.ID)
+	req.Header.Set(hopHeader, strconv.Itoa(meta.Hop))
+	req.Header.Set(callbackStatusHeader, strconv.Itoa(status))
+	if meta.TraceParent != "" {
+		req.Header.Set(traceParentHeader, meta.TraceParent)
+	}
+	if errMsg != "" {
+		req.Header.Set(callbackErrorHeader, strings.Replace(errMsg, "\n", " ", -1))
+	}
+
+	client := externalClient()
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return newStatusError(res)
+	}
+	return nil
+}
+
+// sendCallback sends a result to the callback URL of the request and
+// retries as per the retry policy
+func sendCallback(meta *requestMeta, data []byte, respType string, status int, errMsg string) {
+	rlog := requestLogger(meta).With("callback", meta.CallbackURL)
+	for attempt := 0; ; attempt++ {
+		err := postCallback(meta, bytes.NewReader(data), respType, status, errMsg)
+		if err == nil {
+			rlog.Info("sent result to callback")
+			return
+		}
+		if attempt >= forwardRetries || !retryable(meta, err) {
+			rlog.Error("failed to send result to callback", "error", err)
+			return
+		}
+		wait := backoff(attempt, err)
+		rlog.Warn("failed to send result to callback, retrying", "retry_in", wait, "error", err)
+		time.Sleep(wait)
+	}
+}
+
+// callbackResult sends the output of the last function to the callback
+func callbackResult(meta *requestMeta, data []byte, respType string, status int) {
+	sendCallback(meta, data, respType, status, "")
+}
+
+// callbackError sends the error envelope of the failed function to the
+// callback
+func callbackError(meta *requestMeta, t *target, ferr error) {
+	cerr := forwardError(meta, t, ferr)
+	sendCallback(meta, cerr.encode(), "application/json", cerr.Status, cerr.Error())
+}
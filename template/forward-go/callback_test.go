@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// callbackReceiver records the callbacks it receives, the first failures
+// callbacks fail with 503
+type callbackReceiver struct {
+	failures int
+	lock     sync.Mutex
+	attempts int
+	header   http.Header
+	body     []byte
+}
+
+func newCallbackReceiver(failures int) (*callbackReceiver, *httptest.Server) {
+	rec := &callbackReceiver{failures: failures}
+	return rec, httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		rec.lock.Lock()
+		defer rec.lock.Unlock()
+		rec.attempts++
+		if rec.attempts <= rec.failures {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		rec.header, rec.body = r.Header, body
+	}))
+}
+
+func TestCallbackResult(t *testing.T) {
+	defer setupRetry(2, time.Millisecond, time.Millisecond)()
+	rec, receiver := newCallbackReceiver(1)
+	defer receiver.Close()
+	meta := &requestMeta{ID: genRequestId(), Hop: 3, Async: true, CallbackURL: receiver.URL}
+
+	callbackResult(meta, []byte(`{"done":true}`), "application/json", http.StatusOK)
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+	if rec.attempts != 2 {
+		t.Errorf("expected the failed callback to be retried once, got %d attempts", rec.attempts)
+	}
+	if string(rec.body) != `{"done":true}` || rec.header.Get("Content-Type") != "application/json" {
+		t.Errorf("unexpected result '%s' of type '%s'", rec.body, rec.header.Get("Content-Type"))
+	}
+	// the callback is correlated with the 202 reply by the request ID
+	if rec.header.Get(requestIDHeader) != meta.ID || rec.header.Get(hopHeader) != "3" ||
+		rec.header.Get(callbackStatusHeader) != "200" || rec.header.Get(callbackErrorHeader) != "" {
+		t.Errorf("unexpected callback headers %v", rec.header)
+	}
+}
+
+func TestCallbackError(t *testing.T) {
+	defer setupRetry(0, time.Millisecond, time.Millisecond)()
+	rec, receiver := newCallbackReceiver(0)
+	defer receiver.Close()
+	meta := &requestMeta{ID: genRequestId(), Hop: 1, Async: true, CallbackURL: receiver.URL}
+
+	callbackError(meta, &target{name: "store", addr: "http://store:8080"}, &statusError{code: http.StatusBadGateway, status: "502 Bad Gateway"})
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+	if rec.header.Get(requestIDHeader) != meta.ID || rec.header.Get(callbackStatusHeader) != "502" ||
+		rec.header.Get(callbackErrorHeader) == "" || rec.header.Get("Content-Type") != "application/json" {
+		t.Errorf("unexpected callback headers %v", rec.header)
+	}
+	envelope := &errorEnvelope{}
+	if err := json.Unmarshal(rec.body, envelope); err != nil || envelope.Error == nil {
+		t.Fatalf("expected the error envelope, got '%s'", rec.body)
+	}
+	if envelope.Error.Function != "store" || envelope.Error.Hop != 2 || envelope.Error.Status != http.StatusBadGateway ||
+		envelope.Error.RequestID != meta.ID {
+		t.Errorf("unexpected chain error %+v", envelope.Error)
+	}
+}
+
+func TestCallbackNotRetried(t *testing.T) {
+	defer setupRetry(0, time.Millisecond, time.Millisecond)()
+	rec, receiver := newCallbackReceiver(1)
+	defer receiver.Close()
+	meta := &requestMeta{ID: genRequestId(), Async: true, CallbackURL: receiver.URL}
+
+	callbackResult(meta, []byte("result"), "text/plain", http.StatusOK)
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+	if rec.attempts != 1 || rec.body != nil {
+		t.Errorf("expected a single failed attempt without retries, got %d", rec.attempts)
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// extension of the dead letter info in the dead letter directory
+	infoExt = ".json"
+	// prefix of a dead letter directory
+	dirPrefix = "dir:"
+)
+
+var (
+	deadLetterAddr string
+	deadLetterDir  string
+	// deadLetterExternal is set when the dead letter is a URL rather than a
+	// function of the chain
+	deadLetterExternal = false
+	// replayEnabled exposes the dead letter replay endpoint
+	replayEnabled = false
+)
+
+// deadLetterInfo describes why a request became a dead letter
+type deadLetterInfo struct {
+	RequestID string `json:"request_id"`
+	// Key of the message, the dead letters of a message share it
+	Key      string       `json:"key,omitempty"`
+	Meta     *requestMeta `json:"meta"`
+	Target   string       `json:"target"`
+	Error    string       `json:"error"`
+	Attempts int          `json:"attempts"`
+	Time     time.Time    `json:"time"`
+}
+
+// deadLetterEnabled checks if a dead letter destination is configured
+func deadLetterEnabled() bool {
+	return deadLetterAddr != "" || deadLetterDir != ""
+}
+
+// parseDeadLetter sets the dead letter destination, it can be a http(s)
+// url, a local directory (absolute path or 'dir:' prefixed) or a function
+func parseDeadLetter(val string) {
+	switch {
+	case val == "":
+	case strings.HasPrefix(val, "http://") || strings.HasPrefix(val, "https://"):
+		deadLetterAddr = val
+		deadLetterExternal = true
+	case strings.HasPrefix(val, dirPrefix):
+		deadLetterDir = strings.TrimPrefix(val, dirPrefix)
+	case filepath.IsAbs(val):
+		deadLetterDir = val
+	default:
+		deadLetterAddr = targetAddr(val)
+	}
+}
+
+// sendDeadLetter sends the data of a request that failed to be forwarded
+// to the dead letter destination
+func sendDeadLetter(info *deadLetterInfo, data []byte) error {
+	if deadLetterDir != "" {
+		return writeDeadLetter(info, data)
+	}
+
+	req, err := newForwardRequest(deadLetterAddr, info.Meta, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Dead-Letter-Request-Id", info.RequestID)
+	req.Header.Set("X-Dead-Letter-Target", info.Target)
+	req.Header.Set("X-Dead-Letter-Error", strings.Replace(info.Error, "\n", " ", -1))
+	req.Header.Set("X-Dead-Letter-Attempts", strconv.Itoa(info.Attempts))
+
+	client := forwardClient()
+	if deadLetterExternal {
+		client = externalClient()
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return newStatusError(res)
+	}
+	return nil
+}
+
+// writeDeadLetter writes the request data and the dead letter info to the
+// dead letter directory
+func writeDeadLetter(info *deadLetterInfo, data []byte) error {
+	meta, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	name := filepath.Join(deadLetterDir, deadLetterName(info))
+	err = writeFileSync(name+infoExt, meta)
+	if err != nil {
+		return err
+	}
+	return writeFileSync(name+reqExt, data)
+}
+
+// deadLetterName returns the file name of a dead letter without extension,
+// the key of the message followed by the target so that the messages of a
+// request and the failed branches of a fan-out are kept apart
+func deadLetterName(info *deadLetterInfo) string {
+	target := info.Target
+	if i := strings.Index(target, "://"); i >= 0 {
+		target = target[i+3:]
+	}
+	target = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '.':
+			return r
+		}
+		return '_'
+	}, strings.TrimRight(target, "/"))
+	key := info.Key
+	if key == "" {
+		key = messageKey(info.RequestID)
+	}
+	return filepath.Base(key) + "_" + target
+}
+
+// deadLetter sends a request to the dead letter destination, it returns false
+// when the request is lost
+func deadLetter(key string, meta *requestMeta, data []byte, t *target, attempts int, ferr error) bool {
+	info := &deadLetterInfo{
+		RequestID: meta.ID,
+		Key:       key,
+		Meta:      meta,
+		Target:    t.addr,
+		Error:     ferr.Error(),
+		Attempts:  attempts,
+		Time:      time.Now(),
+	}
+	err := sendDeadLetter(info, data)
+	if err != nil {
+		requestLogger(meta).Error("failed to send request to dead letter, request is lost", "target", t.name, "error", err)
+		return false
+	}
+	deadLetters.inc("")
+	requestLogger(meta).Info("request sent to dead letter", "target", t.name, "attempts", attempts)
+	return true
+}
+
+// replayDeadLetters puts the dead letters of the given request IDs (all if
+// none) back on the request queue to be forwarded to the targets they
+// failed to reach and removes them from the directory, the dead letters
+// of a message are replayed as a single message
+func replayDeadLetters(requestIDs []string) ([]string, error) {
+	files, err := ioutil.ReadDir(deadLetterDir)
+	if err != nil {
+		return nil, err
+	}
+	selected := make(map[string]bool)
+	for _, requestID := range requestIDs {
+		selected[requestID] = true
+	}
+
+	// dead letter files of each message
+	type letters struct {
+		meta  *requestMeta
+		names []string
+	}
+	var order []string
+	messages := make(map[string]*letters)
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), reqExt) {
+			continue
+		}
+		name := filepath.Join(deadLetterDir, strings.TrimSuffix(file.Name(), reqExt))
+		meta := &requestMeta{ID: strings.TrimSuffix(file.Name(), reqExt)}
+		key, target := meta.ID, ""
+		if content, err := ioutil.ReadFile(name + infoExt); err == nil {
+			info := &deadLetterInfo{}
+			if json.Unmarshal(content, info) == nil && info.Meta != nil {
+				meta, target = info.Meta, info.Target
+				if info.Key != "" {
+					key = info.Key
+				}
+			}
+		}
+		if len(selected) > 0 && !selected[meta.ID] {
+			continue
+		}
+		request, ok := messages[key]
+		if !ok {
+			meta.Targets = nil
+			request = &letters{meta: meta}
+			messages[key] = request
+			order = append(order, key)
+		}
+		request.names = append(request.names, name)
+		// a dead letter without target is replayed to every next function
+		if target == "" || (len(request.names) > 1 && len(request.meta.Targets) == 0) {
+			request.meta.Targets = nil
+		} else {
+			request.meta.Targets = append(request.meta.Targets, target)
+		}
+	}
+
+	replayed := []string{}
+	for _, key := range order {
+		request := messages[key]
+		requestID := request.meta.ID
+		data, err := ioutil.ReadFile(request.names[0] + reqExt)
+		if err != nil {
+			return replayed, fmt.Errorf("failed to read dead letter '%s', error: %v", requestID, err)
+		}
+		err = enqueueRequest(request.meta, data)
+		if err != nil {
+			return replayed, fmt.Errorf("failed to store request '%s', error: %v", requestID, err)
+		}
+		for _, name := range request.names {
+			os.Remove(name + reqExt)
+			os.Remove(name + infoExt)
+		}
+		// the replayed message supersedes the dead-lettered one
+		forgetStatus(key)
+		requestLogger(request.meta).Info("replaying dead letter", "targets", strings.Join(request.meta.Targets, ","))
+		replayed = append(replayed, requestID)
+	}
+	return replayed, nil
+}
+
+// handle dead letter replay request, the request IDs to replay can be
+// provided as 'id' query parameters. Replay must be enabled with
+// dead_letter_replay
+func replayHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		if !async || deadLetterDir == "" || !replayEnabled {
+			http.Error(w, "dead letter replay is not enabled", http.StatusNotFound)
+			return
+		}
+		// the replayed requests enter the chain, the caller must provide
+		// the credentials of the chain when it authenticates its callers
+		if authEnabled() {
+			if _, err := authenticate(r); err != nil {
+				logger.Warn("rejecting dead letter replay", "remote", r.RemoteAddr, "error", err)
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+		}
+		replayed, err := replayDeadLetters(r.URL.Query()["id"])
+		if err != nil {
+			logger.Error("failed to replay dead letters", "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		var b bytes.Buffer
+		json.NewEncoder(&b).Encode(replayed)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b.Bytes())
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setupDeadLetter sets a dead letter directory with replay enabled, the
+// returned function restores the config
+func setupDeadLetter(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "deadletter")
+	if err != nil {
+		t.Fatalf("failed to create dead letter directory, error: %v", err)
+	}
+	saved := []interface{}{deadLetterAddr, deadLetterDir, deadLetterExternal, replayEnabled}
+	deadLetterAddr, deadLetterDir, deadLetterExternal, replayEnabled = "", dir, false, true
+	return dir, func() {
+		deadLetterAddr, deadLetterDir = saved[0].(string), saved[1].(string)
+		deadLetterExternal, replayEnabled = saved[2].(bool), saved[3].(bool)
+		os.RemoveAll(dir)
+	}
+}
+
+func TestDeadLetterReplay(t *testing.T) {
+	ok, okNext := newRecorder(0)
+	defer okNext.Close()
+	// the target fails until the request is replayed
+	failing, failingNext := newRecorder(3)
+	defer failingNext.Close()
+	defer setupQueue(t, 10, okNext.URL, failingNext.URL)()
+	defer setupRetry(2, time.Millisecond, time.Millisecond)()
+	dir, restore := setupDeadLetter(t)
+	defer restore()
+
+	meta := &requestMeta{ID: genRequestId()}
+	if err := enqueueRequest(meta, []byte("payload")); err != nil {
+		t.Fatalf("failed to enqueue request, error: %v", err)
+	}
+	forwardQueued(<-requestQueue)
+
+	// the failed target is dead-lettered once the retries run out
+	if count := failing.count(meta.ID); count != 3 {
+		t.Errorf("expected the failed target to be tried 3 times, got %d", count)
+	}
+	if state, _ := getStatus(meta.ID); state.Status != statusDeadLettered {
+		t.Errorf("unexpected status %+v", state)
+	}
+	infos, _ := filepath.Glob(filepath.Join(dir, "*"+infoExt))
+	if len(infos) != 1 {
+		t.Fatalf("expected a single dead letter, got %v", infos)
+	}
+	content, _ := ioutil.ReadFile(infos[0])
+	info := &deadLetterInfo{}
+	if err := json.Unmarshal(content, info); err != nil {
+		t.Fatalf("invalid dead letter info, error: %v", err)
+	}
+	if info.RequestID != meta.ID || info.Target != failingNext.URL || info.Attempts != 3 || info.Error == "" || info.Key == "" {
+		t.Errorf("unexpected dead letter info %+v", info)
+	}
+	data, _ := ioutil.ReadFile(strings.TrimSuffix(infos[0], infoExt) + reqExt)
+	if string(data) != "payload" {
+		t.Errorf("unexpected dead letter data '%s'", data)
+	}
+
+	// the replay is only sent to the target recorded in the dead letter
+	w := httptest.NewRecorder()
+	replayHandler(w, httptest.NewRequest(http.MethodPost, "/_/replay?id="+meta.ID, nil))
+	if w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != `["`+meta.ID+`"]` {
+		t.Fatalf("unexpected replay reply %d '%s'", w.Code, w.Body.String())
+	}
+	forwardQueued(<-requestQueue)
+	if count := failing.count(meta.ID); count != 4 {
+		t.Errorf("expected the replay to reach the failed target, got %d attempts", count)
+	}
+	if count := ok.count(meta.ID); count != 1 {
+		t.Errorf("expected the replay not to reach the other target, got %d requests", count)
+	}
+	if state, _ := getStatus(meta.ID); state.Status != statusDelivered {
+		t.Errorf("unexpected status %+v", state)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("expected the replayed dead letter to be removed, got %d files", len(files))
+	}
+}
+
+func TestReplayDisabled(t *testing.T) {
+	defer setupQueue(t, 10)()
+	_, restore := setupDeadLetter(t)
+	defer restore()
+	replayEnabled = false
+
+	w := httptest.NewRecorder()
+	replayHandler(w, httptest.NewRequest(http.MethodPost, "/_/replay", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected the replay to be disabled, got %d", w.Code)
+	}
+}
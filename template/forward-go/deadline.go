@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// header of the caller providing the time budget of the chain, in
+	// seconds or as a duration such as '1m30s'
+	chainTimeoutHeader = "X-Chain-Timeout"
+	// header carrying the remaining time budget in milliseconds along the
+	// chain
+	budgetHeader = "X-Forward-Budget"
+)
+
+var (
+	// chainTimeout is the time budget of the chain when the caller
+	// provides none, 0 for no budget
+	chainTimeout time.Duration
+)
+
+// chainDeadline returns the deadline of a request received at the head of
+// the chain, zero if it has no budget
+func chainDeadline(r *http.Request) time.Time {
+	budget := parseIntOrDurationValue(r.Header.Get(chainTimeoutHeader), chainTimeout)
+	if budget <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(budget)
+}
+
+// budgetDeadline returns the deadline of a request forwarded by the
+// previous function, zero if it has no budget
+func budgetDeadline(r *http.Request) time.Time {
+	val := r.Header.Get(budgetHeader)
+	if val == "" {
+		return time.Time{}
+	}
+	millis, err := strconv.ParseInt(val, 10, 64)
+	if err != nil || millis < 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(time.Duration(millis) * time.Millisecond)
+}
+
+// remainingBudget returns the remaining time budget of a request in
+// milliseconds
+func remainingBudget(meta *requestMeta) string {
+	remaining := time.Until(meta.Deadline) / time.Millisecond
+	if remaining < 0 {
+		remaining = 0
+	}
+	return strconv.FormatInt(int64(remaining), 10)
+}
+
+// budgetExhausted checks if the deadline of a request is over
+func budgetExhausted(meta *requestMeta) bool {
+	return !meta.Deadline.IsZero() && !time.Now().Before(meta.Deadline)
+}
+
+// rejectExhausted replies 504 to a request whose deadline budget is
+// exhausted before it is handled, true is returned if the request is
+// rejected
+func rejectExhausted(w http.ResponseWriter, meta *requestMeta) bool {
+	if !budgetExhausted(meta) {
+		return false
+	}
+	requestLogger(meta).Warn("rejecting request, deadline budget exhausted")
+	writeError(w, meta, http.StatusGatewayTimeout, "deadline budget of the chain exhausted")
+	return true
+}
+
+// withDeadline returns a context ending at the deadline of the request
+func withDeadline(ctx context.Context, meta *requestMeta) (context.Context, context.CancelFunc) {
+	if meta.Deadline.IsZero() {
+		return context.WithCancel(ctx)
+	}
+	return context.WithDeadline(ctx, meta.Deadline)
+}
+
+// cancelBody releases the context of a forward once the response is read
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// timeoutError checks if an error is caused by a timeout
+func timeoutError(err error) bool {
+	if err == context.DeadlineExceeded {
+		return true
+	}
+	terr, ok := err.(interface {
+		Timeout() bool
+	})
+	return ok && terr.Timeout()
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// handled returns the number of requests the handler ran for
+func handled() uint64 {
+	handlerDuration.lock.Lock()
+	defer handlerDuration.lock.Unlock()
+	if series, ok := handlerDuration.series[""]; ok {
+		return series.count
+	}
+	return 0
+}
+
+// forwardedRequest returns the request forwarded with the meta as received
+// by the next function
+func forwardedRequest(t *testing.T, meta *requestMeta, data string) *http.Request {
+	req, err := newForwardRequest("http://next:8080/", meta, strings.NewReader(data))
+	if err != nil {
+		t.Fatalf("failed to create request, error: %v", err)
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		t.Fatalf("failed to read request, error: %v", err)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(string(body)))
+	r.Header = req.Header
+	return r
+}
+
+func TestBudgetDecreasesAlongTheChain(t *testing.T) {
+	head := httptest.NewRequest(http.MethodPost, "/", nil)
+	head.Header.Set(chainTimeoutHeader, "1s")
+	meta := newMeta(head, genRequestId())
+
+	budgets := make([]int64, 3)
+	for hop := range budgets {
+		time.Sleep(20 * time.Millisecond)
+		next := httptest.NewRequest(http.MethodPost, "/", nil)
+		writeMeta(next, meta)
+		budget, err := strconv.ParseInt(next.Header.Get(budgetHeader), 10, 64)
+		if err != nil {
+			t.Fatalf("invalid budget '%s' at hop %d", next.Header.Get(budgetHeader), hop+1)
+		}
+		budgets[hop] = budget
+		meta = readMeta(next, "")
+	}
+	if budgets[0] > 980 || budgets[1] > budgets[0]-20 || budgets[2] > budgets[1]-20 || budgets[2] <= 0 {
+		t.Errorf("expected the budget to decrease at each hop, got %v", budgets)
+	}
+}
+
+func TestExhaustedBudget(t *testing.T) {
+	saved := inputType
+	inputType = "FILE"
+	defer func() { inputType = saved }()
+
+	// the request is handled within its budget
+	before := handled()
+	w := httptest.NewRecorder()
+	reqHandle(w, forwardedRequest(t, &requestMeta{ID: genRequestId(), Deadline: time.Now().Add(time.Minute)}, "data"))
+	if w.Code == http.StatusGatewayTimeout || handled() != before+1 {
+		t.Fatalf("expected the request to be handled, got %d", w.Code)
+	}
+
+	// the handler doesn't run once the budget is exhausted
+	meta := &requestMeta{ID: genRequestId(), Hop: 1, Deadline: time.Now().Add(-time.Second)}
+	before = handled()
+	w = httptest.NewRecorder()
+	reqHandle(w, forwardedRequest(t, meta, "data"))
+	if w.Code != http.StatusGatewayTimeout || handled() != before {
+		t.Errorf("expected 504 before the handler runs, got %d", w.Code)
+	}
+	envelope := &errorEnvelope{}
+	if err := json.Unmarshal(w.Body.Bytes(), envelope); err != nil || envelope.Error == nil {
+		t.Fatalf("expected the error envelope, error: %v", err)
+	}
+	if envelope.Error.Status != http.StatusGatewayTimeout || envelope.Error.Hop != 2 || envelope.Error.RequestID != meta.ID {
+		t.Errorf("unexpected chain error %+v", envelope.Error)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+)
+
+const (
+	// header marking a response carrying a chain error envelope
+	chainErrorHeader = "X-Forward-Chain-Error"
+	// header carrying the error envelope of the failed handler to the
+	// fallback function
+	failureHeader = "X-Forward-Failure"
+)
+
+// chainError is the error of the function that failed in the chain, it is
+// created by the failing function and returned as is by the previous ones
+type chainError struct {
+	// Function that failed
+	Function string `json:"function"`
+	// Hop is the position of the failed function in the chain
+	Hop int `json:"hop"`
+	// Status of the failure
+	Status int `json:"status"`
+	// Message describing the failure
+	Message string `json:"message"`
+	// RequestID of the failed request
+	RequestID string `json:"request_id"`
+}
+
+func (err *chainError) Error() string {
+	return fmt.Sprintf("function '%s' at hop %d failed with status %d: %s", err.Function, err.Hop, err.Status, err.Message)
+}
+
+// errorEnvelope is the body of a chain error response
+type errorEnvelope struct {
+	Error *chainError `json:"error"`
+}
+
+// newChainError creates the error of a failure in the function
+func newChainError(meta *requestMeta, status int, msg string) *chainError {
+	return &chainError{
+		Function:  functionName,
+		Hop:       meta.Hop,
+		Status:    status,
+		Message:   msg,
+		RequestID: meta.ID,
+	}
+}
+
+// forwardError returns the chain error of a failed forward to a target,
+// the error of the next function is returned as is, any other failure is
+// reported on behalf of the target
+func forwardError(meta *requestMeta, t *target, err error) *chainError {
+	if cerr, ok := err.(*chainError); ok {
+		return cerr
+	}
+	status := http.StatusBadGateway
+	if serr, ok := err.(*statusError); ok {
+		status = serr.code
+	} else if timeoutError(err) {
+		status = http.StatusGatewayTimeout
+	}
+	return &chainError{
+		Function:  t.name,
+		Hop:       meta.Hop + 1,
+		Status:    status,
+		Message:   err.Error(),
+		RequestID: meta.ID,
+	}
+}
+
+// encode returns the error envelope of the chain error
+func (err *chainError) encode() []byte {
+	body, _ := json.Marshal(&errorEnvelope{Error: err})
+	return body
+}
+
+// writeChainError replies with the error envelope of a chain error
+func writeChainError(w http.ResponseWriter, err *chainError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(chainErrorHeader, strconv.Itoa(err.Hop))
+	w.WriteHeader(err.Status)
+	w.Write(err.encode())
+}
+
+// writeError replies with the error envelope of a failure in the function
+func writeError(w http.ResponseWriter, meta *requestMeta, status int, msg string) {
+	writeChainError(w, newChainError(meta, status, msg))
+}
+
+// readChainError reads the error envelope of a response, nil is returned
+// if the response doesn't carry one
+func readChainError(res *http.Response) *chainError {
+	if res.Header.Get(chainErrorHeader) == "" {
+		return nil
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return nil
+	}
+	envelope := &errorEnvelope{}
+	if json.Unmarshal(body, envelope) != nil || envelope.Error == nil {
+		return nil
+	}
+	return envelope.Error
+}
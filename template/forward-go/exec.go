@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"handler/sdk"
+	"net/http"
+	"runtime/debug"
+	"time"
+)
+
+var (
+	// execTimeout is the time the handler is given to handle a request,
+	// 0 for no limit
+	execTimeout time.Duration
+)
+
+// panicError is returned when the handler panics
+type panicError struct {
+	value interface{}
+}
+
+func (err *panicError) Error() string {
+	return fmt.Sprintf("handler panicked: %v", err.value)
+}
+
+// execTimeoutError is returned when the handler doesn't return in time
+type execTimeoutError struct {
+	err error
+}
+
+func (err *execTimeoutError) Error() string {
+	return fmt.Sprintf("handler timed out, error: %v", err.err)
+}
+
+// requestEndedError is returned when the request ends before the handler
+// returns, as the caller is gone or the write timeout or the deadline of
+// the chain is reached
+type requestEndedError struct {
+	err error
+}
+
+func (err *requestEndedError) Error() string {
+	return fmt.Sprintf("request ended before the handler returned, error: %v", err.err)
+}
+
+// handlerErrorStatus returns the status to reply when the handler fails
+func handlerErrorStatus(err error) int {
+	switch herr := err.(type) {
+	case *execTimeoutError:
+		return http.StatusGatewayTimeout
+	case *requestEndedError:
+		if timeoutError(herr.err) {
+			return http.StatusGatewayTimeout
+		}
+	}
+	return http.StatusInternalServerError
+}
+
+// contextError returns the error of a handler whose context ended, only the
+// expiry of the exec timeout is a handler timeout while the request ending
+// before it is reported with its own cause
+func contextError(parent context.Context, err error) error {
+	if perr := parent.Err(); perr != nil {
+		return &requestEndedError{err: perr}
+	}
+	handlerTimeouts.inc("")
+	return &execTimeoutError{err: err}
+}
+
+// recoverHandler turns a panic of the handler into a panicError, the
+// stack is logged with the request fields
+func recoverHandler(req *sdk.Request, err *error) {
+	value := recover()
+	if value == nil {
+		return
+	}
+	handlerPanics.inc("")
+	req.Log.Error("handler panicked", "panic", value, "stack", string(debug.Stack()))
+	*err = &panicError{value: value}
+}
+
+// withExecTimeout returns the request with its context ending at the exec
+// timeout
+func withExecTimeout(req *sdk.Request) (*sdk.Request, context.CancelFunc) {
+	if execTimeout <= 0 {
+		return req, func() {}
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), execTimeout)
+	return req.WithContext(ctx), cancel
+}
+
+// runHandler runs the handler, a handler that is still running once its
+// context ends is abandoned and the request fails
+func runHandler(req *sdk.Request) (*sdk.Response, error) {
+	parent := req.Context()
+	req, cancel := withExecTimeout(req)
+	defer cancel()
+
+	type result struct {
+		resp *sdk.Response
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		var res result
+		defer func() { done <- res }()
+		defer recoverHandler(req, &res.err)
+		res.resp, res.err = handle(req)
+	}()
+
+	if execTimeout <= 0 {
+		res := <-done
+		return res.resp, res.err
+	}
+	select {
+	case res := <-done:
+		return res.resp, res.err
+	case <-req.Context().Done():
+		return nil, contextError(parent, req.Context().Err())
+	}
+}
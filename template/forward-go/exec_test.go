@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"handler/sdk"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// panics returns the number of panics of the handler
+func panics() float64 {
+	handlerPanics.lock.Lock()
+	defer handlerPanics.lock.Unlock()
+	return handlerPanics.values[""]
+}
+
+func TestContextError(t *testing.T) {
+	// the caller is gone before the exec timeout
+	parent, cancelParent := context.WithCancel(context.Background())
+	ctx, cancel := context.WithTimeout(parent, time.Hour)
+	defer cancel()
+	cancelParent()
+	<-ctx.Done()
+	err := contextError(parent, ctx.Err())
+	if rerr, ok := err.(*requestEndedError); !ok || rerr.err != context.Canceled {
+		t.Errorf("expected the request to be reported canceled, got %v", err)
+	}
+	if status := handlerErrorStatus(err); status != http.StatusInternalServerError {
+		t.Errorf("unexpected status %d for a canceled request", status)
+	}
+
+	// the write timeout or the deadline of the chain is reached first
+	parent, cancelParent = context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancelParent()
+	ctx, cancel = context.WithTimeout(parent, time.Hour)
+	defer cancel()
+	<-ctx.Done()
+	err = contextError(parent, ctx.Err())
+	if rerr, ok := err.(*requestEndedError); !ok || rerr.err != context.DeadlineExceeded {
+		t.Errorf("expected the request deadline to be reported, got %v", err)
+	}
+	if status := handlerErrorStatus(err); status != http.StatusGatewayTimeout {
+		t.Errorf("unexpected status %d for a request past its deadline", status)
+	}
+
+	// the exec timeout expires
+	ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	<-ctx.Done()
+	err = contextError(context.Background(), ctx.Err())
+	if _, ok := err.(*execTimeoutError); !ok {
+		t.Errorf("expected an exec timeout, got %v", err)
+	}
+	if status := handlerErrorStatus(err); status != http.StatusGatewayTimeout {
+		t.Errorf("unexpected status %d for an exec timeout", status)
+	}
+}
+
+func TestRecoverHandler(t *testing.T) {
+	req := (&sdk.Request{ID: genRequestId(), Log: logger}).WithContext(context.Background())
+	before := panics()
+	err := func() (err error) {
+		defer recoverHandler(req, &err)
+		panic("boom")
+	}()
+	if perr, ok := err.(*panicError); !ok || perr.value != "boom" {
+		t.Fatalf("expected the panic to be recovered as an error, got %v", err)
+	}
+	if status := handlerErrorStatus(err); status != http.StatusInternalServerError {
+		t.Errorf("unexpected status %d for a panic", status)
+	}
+	if count := panics(); count != before+1 {
+		t.Errorf("expected the panic to be counted, got %v", count-before)
+	}
+}
+
+func TestHandlerPanic(t *testing.T) {
+	savedHandle, savedInput := handleStream, inputType
+	defer func() { handleStream, inputType = savedHandle, savedInput }()
+	inputType = "POST"
+	handleStream = func(req *sdk.Request, in io.Reader, out io.Writer) error {
+		panic("boom")
+	}
+
+	before := panics()
+	w := httptest.NewRecorder()
+	reqHandle(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader("data")))
+	if w.Code != http.StatusInternalServerError || w.Header().Get(chainErrorHeader) != "0" {
+		t.Errorf("unexpected reply %d, chain error '%s'", w.Code, w.Header().Get(chainErrorHeader))
+	}
+	envelope := &errorEnvelope{}
+	if err := json.Unmarshal(w.Body.Bytes(), envelope); err != nil || envelope.Error == nil {
+		t.Fatalf("expected the error envelope, got '%s'", w.Body.String())
+	}
+	if envelope.Error.Status != http.StatusInternalServerError || !strings.Contains(envelope.Error.Message, "handler panicked: boom") {
+		t.Errorf("unexpected chain error %+v", envelope.Error)
+	}
+	if count := panics(); count != before+1 {
+		t.Errorf("expected the panic to be counted, got %v", count-before)
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+var (
+	forwardTargets  []*target
+	fanoutAggregate = "json"
+	fanoutOnError   = "abort"
+	// forwardMode is how a function name is reached, 'direct' calls the
+	// function service, 'gateway' and 'gateway-async' call the function
+	// through the gateway
+	forwardMode = "direct"
+	gatewayURL  = "http://gateway:8080"
+)
+
+// target is a function the output is forwarded to
+type target struct {
+	name string
+	addr string
+}
+
+// fanoutResult is the outcome of forwarding to a target
+type fanoutResult struct {
+	forwardResponse
+	target   *target
+	attempts int
+	err      error
+}
+
+// branchResult is a fan-out branch in a json aggregated response
+type branchResult struct {
+	Function    string          `json:"function"`
+	Status      int             `json:"status"`
+	ContentType string          `json:"content_type,omitempty"`
+	Body        json.RawMessage `json:"body,omitempty"`
+	Error       string          `json:"error,omitempty"`
+}
+
+// parseTargets parses the comma separated list of functions to forward to
+func parseTargets(val string) []*target {
+	var targets []*target
+	for _, name := range strings.Split(val, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		targets = append(targets, &target{name: name, addr: targetAddr(name)})
+	}
+	return targets
+}
+
+// targetAddr returns the address of a function, a full URL is used as is
+// while a function name, optionally qualified by its namespace as in
+// 'name.namespace', is reached as per the forward mode
+func targetAddr(name string) string {
+	if strings.HasPrefix(name, "http://") || strings.HasPrefix(name, "https://") {
+		return name
+	}
+	switch forwardMode {
+	case "gateway":
+		return strings.TrimSuffix(gatewayURL, "/") + "/function/" + name
+	case "gateway-async":
+		return strings.TrimSuffix(gatewayURL, "/") + "/async-function/" + name
+	}
+	return forwardScheme + "://" + name + ":8080"
+}
+
+// fanout forwards the request data to every target in parallel
+func fanout(targets []*target, meta *requestMeta, data []byte) []*fanoutResult {
+	results := make([]*fanoutResult, len(targets))
+	var wg sync.WaitGroup
+	for i, t := range targets {
+		wg.Add(1)
+		go func(i int, t *target) {
+			defer wg.Done()
+			client := forwardClient()
+			result := &fanoutResult{target: t}
+			resp, attempts, err := forwardWithRetry(client, t.addr, meta, data)
+			if resp != nil {
+				result.forwardResponse = *resp
+			}
+			result.attempts, result.err = attempts, err
+			results[i] = result
+		}(i, t)
+	}
+	wg.Wait()
+	return results
+}
+
+// failedBranches returns the fan-out results that failed
+func failedBranches(results []*fanoutResult) []*fanoutResult {
+	var failed []*fanoutResult
+	for _, result := range results {
+		if result.err != nil {
+			failed = append(failed, result)
+		}
+	}
+	return failed
+}
+
+// statusOf returns the status to report for a fan-out result
+func statusOf(result *fanoutResult) int {
+	if result.err == nil {
+		return result.status
+	}
+	switch err := result.err.(type) {
+	case *statusError:
+		return err.code
+	case *chainError:
+		return err.Status
+	}
+	return http.StatusBadGateway
+}
+
+// aggregate merges the results of a sync fan-out as a single response,
+// failed branches are dropped unless the fan-out error mode is 'partial'
+func aggregate(results []*fanoutResult) (*forwardResponse, error) {
+	var included []*fanoutResult
+	for _, result := range results {
+		if result.err == nil || fanoutOnError == "partial" {
+			included = append(included, result)
+		}
+	}
+
+	var aggregated forwardResponse
+	var err error
+	if fanoutAggregate == "multipart" {
+		aggregated.data, aggregated.respType, err = aggregateMultipart(included)
+	} else {
+		aggregated.data, aggregated.respType, err = aggregateJSON(included)
+	}
+	if err != nil {
+		return nil, err
+	}
+	aggregated.status = http.StatusOK
+	return &aggregated, nil
+}
+
+// aggregateJSON merges the results as a json array, a json body is embedded
+// as is and any other body as a string
+func aggregateJSON(results []*fanoutResult) ([]byte, string, error) {
+	branches := make([]branchResult, 0, len(results))
+	for _, result := range results {
+		branch := branchResult{
+			Function:    result.target.name,
+			Status:      statusOf(result),
+			ContentType: result.respType,
+		}
+		switch {
+		case result.err != nil:
+			branch.Error = result.err.Error()
+		case json.Valid(result.data):
+			branch.Body = result.data
+		case utf8.Valid(result.data):
+			body, _ := json.Marshal(string(result.data))
+			branch.Body = body
+		default:
+			logger.Warn("dropping binary output from json aggregate, use multipart fanout_aggregate", "target", result.target.name)
+		}
+		branches = append(branches, branch)
+	}
+	data, err := json.Marshal(branches)
+	return data, "application/json", err
+}
+
+// aggregateMultipart merges the results as a multipart/mixed body with a
+// part per function
+func aggregateMultipart(results []*fanoutResult) ([]byte, string, error) {
+	var b bytes.Buffer
+	w := multipart.NewWriter(&b)
+	for _, result := range results {
+		header := make(textproto.MIMEHeader)
+		header.Set("X-Forward-Function", result.target.name)
+		header.Set("X-Forward-Status", strconv.Itoa(statusOf(result)))
+		body := result.data
+		if result.err != nil {
+			header.Set("Content-Type", "text/plain")
+			body = []byte(result.err.Error())
+		} else if result.respType != "" {
+			header.Set("Content-Type", result.respType)
+		}
+		part, err := w.CreatePart(header)
+		if err != nil {
+			return nil, "", err
+		}
+		part.Write(body)
+	}
+	err := w.Close()
+	if err != nil {
+		return nil, "", err
+	}
+	return b.Bytes(), "multipart/mixed; boundary=" + w.Boundary(), nil
+}
+
+// fanoutResponse returns the response of a sync forward, the output of a
+// single target is returned as is while the outputs of multiple targets
+// are aggregated as per the fan-out error mode
+func fanoutResponse(meta *requestMeta, results []*fanoutResult) (*forwardResponse, *chainError) {
+	failed := failedBranches(results)
+	switch {
+	case len(failed) == 0:
+	case len(results) == 1, fanoutOnError == "abort":
+		return nil, forwardError(meta, failed[0].target, failed[0].err)
+	case fanoutOnError == "ignore" && len(failed) == len(results):
+		return nil, forwardError(meta, failed[0].target, failed[0].err)
+	}
+	if len(results) == 1 {
+		return &results[0].forwardResponse, nil
+	}
+	aggregated, err := aggregate(results)
+	if err != nil {
+		return nil, newChainError(meta, http.StatusInternalServerError, fmt.Sprintf("failed to aggregate the fan-out results, error: %v", err))
+	}
+	return aggregated, nil
+}
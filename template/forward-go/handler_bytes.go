@@ -0,0 +1,18 @@
+//go:build !request && !stream
+// +build !request,!stream
+
+package main
+
+import (
+	"handler/function"
+	"handler/sdk"
+)
+
+// handle the request using the user defined Handle
+func handle(req *sdk.Request) (*sdk.Response, error) {
+	body, err := function.Handle(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	return &sdk.Response{Body: body}, nil
+}
@@ -0,0 +1,21 @@
+//go:build request
+// +build request
+
+package main
+
+import (
+	"handler/function"
+	"handler/sdk"
+)
+
+// handle the request using the user defined HandleRequest
+func handle(req *sdk.Request) (*sdk.Response, error) {
+	resp, err := function.HandleRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp == nil {
+		resp = &sdk.Response{}
+	}
+	return resp, nil
+}
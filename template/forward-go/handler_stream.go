@@ -0,0 +1,25 @@
+//go:build stream
+// +build stream
+
+package main
+
+import (
+	"bytes"
+	"handler/function"
+	"handler/sdk"
+)
+
+func init() {
+	handleStream = function.HandleStream
+}
+
+// handle the request using the user defined HandleStream, the output is
+// buffered when it can't be streamed to the next function
+func handle(req *sdk.Request) (*sdk.Response, error) {
+	var b bytes.Buffer
+	err := function.HandleStream(req, bytes.NewReader(req.Body), &b)
+	if err != nil {
+		return nil, err
+	}
+	return &sdk.Response{Body: b.Bytes()}, nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"handler/sdk"
+	"os"
+	"strings"
+)
+
+var (
+	// functionName is the name of the function in the logs and the spans
+	functionName string
+	// logger writes the lines of the function, it is configured by
+	// initLogger
+	logger = sdk.NewLogger(sdk.LogText, os.Stderr)
+)
+
+// initLogger sets the log format and the function name of the logger
+func initLogger() {
+	functionName = os.Getenv("function_name")
+	if functionName == "" {
+		functionName, _ = os.Hostname()
+	}
+	format := strings.ToLower(os.Getenv("log_format"))
+	logger = sdk.NewLogger(format, os.Stderr).With("function", functionName)
+	switch format {
+	case "", sdk.LogText, sdk.LogJSON, sdk.LogLogfmt:
+	default:
+		logger.Warn("invalid log_format, using text", "log_format", format)
+	}
+}
+
+// requestLogger returns the logger of a request, its lines carry the
+// request ID and the hop
+func requestLogger(meta *requestMeta) *sdk.Logger {
+	return logger.With("request_id", meta.ID, "hop", meta.Hop)
+}
@@ -3,12 +3,13 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"fmt"
 	"github.com/rs/xid"
-	"handler/function"
+	"handler/sdk"
 	"io"
 	"io/ioutil"
-	"log"
+	"math/rand"
 	"mime/multipart"
 	"net/http"
 	"os"
@@ -31,9 +32,8 @@ var (
 	forwardEnable        = true
 	async                = false
 	contentType          = "application/octet-stream"
-	forwardAddr          string
-	reqStore             = make(map[string][]byte)
-	requestQueue         = make(chan string, 10)
+	requestQueue         chan *queuedRequest
+	forwardWorkers       = 1
 	readTimeout          time.Duration
 	writeTimeout         time.Duration
 	acceptingConnections bool
@@ -45,11 +45,63 @@ func genRequestId() string {
 	return id.String()
 }
 
+// newHandlerRequest creates the request of the handler and starts its
+// span, the next functions are traced as children of the handler span. The
+// handler context ends with the caller, the write timeout or the deadline
+// of the chain, the returned cancel releases it
+func newHandlerRequest(r *http.Request, meta *requestMeta, body []byte) (*sdk.Request, *span, context.CancelFunc) {
+	ctx := r.Context()
+	cancelWrite := func() {}
+	if writeTimeout > 0 {
+		ctx, cancelWrite = context.WithTimeout(ctx, writeTimeout)
+	}
+	ctx, cancelDeadline := withDeadline(ctx, meta)
+	span := startSpan(meta, "handle", spanKindServer)
+	meta.TraceParent = span.traceParent()
+	req := &sdk.Request{
+		ID:          meta.ID,
+		Hop:         meta.Hop,
+		Origin:      meta.Origin,
+		Method:      r.Method,
+		Header:      r.Header,
+		Query:       r.URL.Query(),
+		Body:        body,
+		TraceParent: meta.TraceParent,
+		Identity:    meta.Identity,
+		Log:         requestLogger(meta),
+	}
+	cancel := func() {
+		cancelDeadline()
+		cancelWrite()
+	}
+	return req.WithContext(ctx), span, cancel
+}
+
 // upload logic
 func reqHandle(w http.ResponseWriter, r *http.Request) {
 
+	requestsTotal.inc(inputType)
+
+	// forwarded requests are only trusted once their signature is verified
+	if rejectUnsigned(w, r) {
+		return
+	}
+
+	// the caller of the chain is authenticated at the head
+	r, rejected := rejectUnauthenticated(w, r)
+	if rejected {
+		return
+	}
+
+	if streamable() {
+		reqHandleStream(w, r)
+		return
+	}
+
 	var body []byte
+	var bodyType string
 	var requestID string
+	var meta *requestMeta
 	var err error
 
 	// in case no failure get requestID and data
@@ -59,69 +111,134 @@ func reqHandle(w http.ResponseWriter, r *http.Request) {
 		// Try to read request as forwarded request
 		err = r.ParseMultipartForm(32 << 20)
 		if err != nil {
-			log.Printf("failed to parse forwarded data, error: %v", err)
-			http.Error(w, fmt.Sprintf("failed to parse forwarded data, error: %v", err), http.StatusInternalServerError)
+			logger.Error("failed to parse forwarded data", "error", err)
+			writeError(w, readMeta(r, ""), http.StatusBadRequest, fmt.Sprintf("failed to parse forwarded data, error: %v", err))
 			return
 		}
 		req, header, err := r.FormFile(fileFormName)
 		if err != nil {
-			log.Printf("failed to parse forwarded data, error: %v", err)
-			http.Error(w, fmt.Sprintf("failed to parse forwarded data, error: %v", err), http.StatusInternalServerError)
+			logger.Error("failed to parse forwarded data", "error", err)
+			writeError(w, readMeta(r, ""), http.StatusBadRequest, fmt.Sprintf("failed to parse forwarded data, error: %v", err))
 			return
 		}
 		defer req.Close()
-		requestID = header.Filename
+		bodyType = header.Header.Get("Content-Type")
+		meta = readMeta(r, header.Filename)
+		requestID = meta.ID
 		reqsize := header.Size
-		log.Printf("received request with request-ID '%s' with size '%d'", requestID, reqsize)
+		requestLogger(meta).Info("received forwarded request", "size", reqsize)
 		body, err = ioutil.ReadAll(req)
 		if err != nil {
-			log.Printf("failed to read forwarded request with ID '%s', error: %v", requestID, err)
-			http.Error(w, fmt.Sprintf("failed to read forwarded request with ID '%s', error: %v", requestID, err), http.StatusInternalServerError)
+			requestLogger(meta).Error("failed to read forwarded request", "error", err)
+			writeError(w, meta, http.StatusBadRequest, fmt.Sprintf("failed to read forwarded request, error: %v", err))
 			return
 		}
+		if signingEnabled() {
+			sum := sha256.Sum256(body)
+			err = verifyDigest(r, sum[:], r.PostFormValue(digestFormName))
+			if err != nil {
+				requestLogger(meta).Warn("rejecting forwarded request", "remote", r.RemoteAddr, "error", err)
+				writeError(w, meta, http.StatusUnauthorized, err.Error())
+				return
+			}
+		}
 	case "POST":
 		// Generate the request id
 		requestID = genRequestId()
-		log.Printf("received fresh request, generated request ID: %s", requestID)
+		bodyType = r.Header.Get("Content-Type")
+		meta = newMeta(r, requestID)
+		requestLogger(meta).Info("received fresh request, generated request ID")
 		body, err = ioutil.ReadAll(r.Body)
 		if err != nil {
-			log.Printf("failed to read forwarded request '%s', error: %v", requestID, err)
-			http.Error(w, fmt.Sprintf("failed to read forwarded request '%s', error: %v", requestID, err), http.StatusInternalServerError)
+			requestLogger(meta).Error("failed to read request", "error", err)
+			writeError(w, meta, http.StatusBadRequest, fmt.Sprintf("failed to read request, error: %v", err))
 			return
 		}
 	}
 
+	requestSize.observe("", float64(len(body)))
+	rlog := requestLogger(meta)
+
+	// the request is dropped once the chain caller gave up
+	if rejectExhausted(w, meta) {
+		return
+	}
+
+	req, span, cancel := newHandlerRequest(r, meta, body)
+	defer cancel()
+
 	// handle the request using user defined handler
-	respbytes, err := function.Handle(body)
+	start := time.Now()
+	resp, err := runHandler(req)
+	handlerDuration.observe("", time.Since(start).Seconds())
+	span.finish(err)
 	if err != nil {
-		// in case of failure just fallback
-		log.Printf("Failed to handle request: %v", err)
-		http.Error(w, fmt.Sprintf("Failed to handle request: %v", err), http.StatusInternalServerError)
-		return
+		handlerErrors.inc("")
+		// the chain goes on as per the error policy
+		resp = errorResponse(body, bodyType)
+		if resp == nil {
+			rlog.Error("Failed to handle request", "error", err)
+			writeError(w, meta, handlerErrorStatus(err), fmt.Sprintf("Failed to handle request: %v", err))
+			return
+		}
+		rlog.Warn("Failed to handle request, applying on_error policy", "on_error", onError, "error", err)
+		if onError == "fallback" {
+			meta.Fallback = true
+			meta.Failure = newChainError(meta, handlerErrorStatus(err), fmt.Sprintf("Failed to handle request: %v", err))
+		}
+	}
+	if resp.ContentType == "" {
+		resp.ContentType = contentType
 	}
+	meta.ContentType = resp.ContentType
+	respbytes := resp.Body
+	responseSize.observe("", float64(len(respbytes)))
 
-	if !forwardEnable {
-		w.Write(respbytes)
-		w.Header().Set("Content-Type", contentType)
+	if resp.StatusCode == 0 {
+		resp.StatusCode = http.StatusOK
+	}
+
+	// find the next functions, the chain ends if there is none
+	targets := forwardTargetsOf(meta, respbytes)
+
+	// a non 2xx status set by the handler ends the chain
+	if (!forwardEnable && !meta.Fallback) || len(targets) == 0 || resp.StatusCode >= 300 {
+		if needsCallback(meta) {
+			callbackResult(meta, respbytes, resp.ContentType, resp.StatusCode)
+		}
+		for key, values := range resp.Header {
+			w.Header()[key] = values
+		}
+		writeResult(w, &forwardResponse{data: respbytes, respType: resp.ContentType, status: resp.StatusCode})
 		return
 	}
 
 	// Check for request to perform in Sync
 	switch async {
 	case true:
-		reqStore[requestID] = respbytes
 		// put on the request queue to be performed in async
-		requestQueue <- requestID
-	case false:
-		client := &http.Client{}
-		data, respType, err := forward(client, forwardAddr, requestID, respbytes)
+		err = enqueueRequest(meta, respbytes)
+		if qerr, ok := err.(*queueFullError); ok {
+			rlog.Warn("rejecting request", "error", err)
+			rejectRequest(w, meta, qerr)
+			return
+		}
 		if err != nil {
-			log.Printf("failed to request %s, error : %v", forwardAddr, err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			rlog.Error("failed to store request", "error", err)
+			writeError(w, meta, http.StatusInternalServerError, fmt.Sprintf("failed to store request, error: %v", err))
 			return
 		}
-		w.Write(data)
-		w.Header().Set("Content-Type", respType)
+		writeAccepted(w, requestID)
+	case false:
+		result, cerr := fanoutResponse(meta, fanout(targets, meta, respbytes))
+		if cerr != nil {
+			// the error of the failed function is returned as is
+			rlog.Error("failed to forward request", "error", cerr)
+			writeChainError(w, cerr)
+			return
+		}
+		// the result of the last function is returned as is
+		writeResult(w, result)
 		// TODO: Post request handler (we might implement it later)
 		//       This way the last function on the chain would be executed at first
 		//       although user approah is more likely to be:
@@ -130,79 +247,196 @@ func reqHandle(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
-// forward the request data
-func forward(client *http.Client, url string, requestID string, data []byte) (result []byte, respType string, err error) {
-
-	// Prepare a form that you will submit to that URL.
-	var b bytes.Buffer
+// newForwardRequest creates the multipart request that carries the data
+// to the next function, the form is streamed while the request is sent
+func newForwardRequest(url string, meta *requestMeta, data io.Reader) (req *http.Request, err error) {
 
-	w := multipart.NewWriter(&b)
+	pr, pw := io.Pipe()
 
-	var fw io.Writer
+	w := multipart.NewWriter(pw)
 
-	if fw, err = w.CreateFormFile("file", requestID); err != nil {
+	req, err = http.NewRequest("POST", url, pr)
+	if err != nil {
+		pr.Close()
 		return
 	}
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	writeMeta(req, meta)
+	signRequest(req)
+	sig := req.Header.Get(signatureHeader)
+
+	// Write the form that you will submit to that URL, the pipe is closed
+	// by the client once the request is sent or failed
+	go func() {
+		fw, err := w.CreateFormFile("file", meta.ID)
+		digest := sha256.New()
+		if err == nil {
+			_, err = io.Copy(io.MultiWriter(fw, digest), data)
+		}
+		// the data of a signed request is signed once it is sent
+		if err == nil && sig != "" {
+			err = w.WriteField(digestFormName, digestSignature(sig, digest.Sum(nil)))
+		}
+		if err == nil {
+			err = w.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	return
+}
+
+// forwardResponse is the result of a function returned along the chain
+type forwardResponse struct {
+	data     []byte
+	respType string
+	status   int
+}
 
-	fw.Write(data)
+// writeResult writes the result of the chain, the status is marked as set
+// by a function so that it is returned as is by the previous functions
+func writeResult(w http.ResponseWriter, result *forwardResponse) {
+	status := result.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	if result.respType != "" {
+		w.Header().Set("Content-Type", result.respType)
+	}
+	w.Header().Set(statusHeader, strconv.Itoa(status))
+	w.WriteHeader(status)
+	w.Write(result.data)
+}
 
-	w.Close()
+// forwardStream forwards the request data as it is read and returns the
+// response of the next function, the caller must close the response body
+func forwardStream(client *http.Client, url string, meta *requestMeta, data io.Reader) (*http.Response, error) {
 
-	req, err := http.NewRequest("POST", url, &b)
+	req, err := newForwardRequest(url, meta, data)
 	if err != nil {
-		return
+		return nil, err
 	}
-	req.Header.Set("Content-Type", w.FormDataContentType())
+
+	// the next function is traced as a child of the forward span
+	span := startSpan(meta, "forward", spanKindClient)
+	span.setAttr("http.url", url)
+	req.Header.Set(traceParentHeader, span.traceParent())
+
+	// the forward ends with the deadline of the chain
+	ctx, cancel := withDeadline(context.Background(), meta)
+	req = req.WithContext(ctx)
 
 	// Submit the request
+	forwardAttempts.inc(url)
+	start := time.Now()
 	res, err := client.Do(req)
+	forwardDuration.observe(url, time.Since(start).Seconds())
 	if err != nil {
-		return
+		cancel()
+		forwardFailures.inc(url)
+		span.finish(err)
+		return nil, err
 	}
-	defer res.Body.Close()
+	span.setAttr("http.status_code", strconv.Itoa(res.StatusCode))
+
+	// Check the response, any status set by a function is a valid result
+	// while a target that isn't a function of the chain, such as the async
+	// gateway or a webhook, accepts the request with any 2xx
+	success := res.StatusCode >= 200 && res.StatusCode <= 299
+	if !success && res.Header.Get(statusHeader) == "" {
+		forwardFailures.inc(url)
+		if cerr := readChainError(res); cerr != nil {
+			err = cerr
+		} else {
+			err = newStatusError(res)
+		}
+		res.Body.Close()
+		cancel()
+		span.finish(err)
+		return nil, err
+	}
+	span.finish(nil)
+	res.Body = &cancelBody{ReadCloser: res.Body, cancel: cancel}
+	return res, nil
+}
+
+// forward the request data
+func forward(client *http.Client, url string, meta *requestMeta, data []byte) (result *forwardResponse, err error) {
 
-	// Check the response
-	if res.StatusCode != http.StatusOK {
-		err = fmt.Errorf("bad status: %s", res.Status)
+	res, err := forwardStream(client, url, meta, bytes.NewReader(data))
+	if err != nil {
 		return
 	}
+	defer res.Body.Close()
 
-	respType = res.Header.Get("Content-Type")
+	result = &forwardResponse{
+		respType: res.Header.Get("Content-Type"),
+		status:   res.StatusCode,
+	}
 
 	// Read the result
-	result, err = ioutil.ReadAll(res.Body)
+	result.data, err = ioutil.ReadAll(res.Body)
 
 	return
 }
 
-// forward request to the function
-func forwardToFunction(requestID string) error {
-	client := &http.Client{}
-	_, _, err := forward(client, forwardAddr, requestID, reqStore[requestID])
-	if err != nil {
-		return err
+// The request forwarder thread, several forwarders consume the request
+// queue concurrently
+func forwarder() {
+	// consume from the request queue
+	for queued := range requestQueue {
+		forwardQueued(queued)
 	}
-	return nil
 }
 
-// The request forwarder thread
-func forwarder() {
-	for true {
-		// read from channel
-		select {
-		// consume from the request queue
-		case requestID := <-requestQueue:
-			log.Printf("New request '%s' received from queue", requestID)
-			err := forwardToFunction(requestID)
-			if err != nil {
-				log.Printf("failed to forward the request to '%s', error %v", requestID, err)
+// forwardQueued forwards a request taken from the request queue, it is
+// requeued or dead-lettered as per the config when a target fails
+func forwardQueued(queued *queuedRequest) {
+	meta, data := queued.meta, queued.data
+	rlog := requestLogger(meta)
+	rlog.Info("New request received from queue")
+	setStatus(queued.key, meta.ID, statusForwarding, nil)
+	requeue := false
+	status := statusDelivered
+	var lastErr error
+	var pending []string
+	targets := pendingTargets(meta, data)
+	for _, result := range failedBranches(fanout(targets, meta, data)) {
+		rlog.Error("failed to forward the request", "target", result.target.name, "attempts", result.attempts, "error", result.err)
+		lastErr = result.err
+		switch {
+		case deadLetterEnabled():
+			if !deadLetter(queued.key, meta, data, result.target, result.attempts, result.err) {
+				status = statusFailed
+			} else if status != statusFailed {
+				status = statusDeadLettered
 			}
-			// delete the request buffer from req Store
-			delete(reqStore, requestID)
+		case queuePersistent() && !budgetExhausted(meta):
+			requeue = true
+			pending = append(pending, result.target.name)
 		default:
-			time.Sleep(100 * time.Millisecond)
+			status = statusFailed
+		}
+		// the caller is told about the failure once it is final
+		if !requeue && needsCallback(meta) {
+			callbackError(meta, result.target, result.err)
+		}
+	}
+	// a persisted request is kept until the next functions accept it
+	if requeue {
+		// only the failed targets are retried, the persisted request
+		// is updated so that a restart doesn't resend to the others
+		meta.Targets = pending
+		if err := storeRequest(queued); err != nil {
+			rlog.Error("failed to update the request in queue", "error", err)
 		}
+		setStatus(queued.key, meta.ID, statusQueued, lastErr)
+		requeueRequest(queued)
+		return
 	}
+	// delete the persisted request, the final status is only set
+	// once the request is gone
+	deleteRequest(queued.key)
+	setStatus(queued.key, meta.ID, status, lastErr)
 }
 
 func lockFilePresent() bool {
@@ -215,7 +449,7 @@ func lockFilePresent() bool {
 
 func createLockFile() (string, error) {
 	path := filepath.Join(os.TempDir(), ".lock")
-	log.Printf("Writing lock-file to: %s\n", path)
+	logger.Info("Writing lock-file", "path", path)
 	writeErr := ioutil.WriteFile(path, []byte{}, 0660)
 	acceptingConnections = true
 
@@ -255,14 +489,58 @@ func parseIntOrDurationValue(val string, fallback time.Duration) time.Duration {
 
 // initialize
 func initialize() {
-	forwardAddr = os.Getenv("forward")
-	if forwardAddr == "" {
-		log.Printf("No forward address provided, considering function as end of chain")
+	initLogger()
+
+	switch strings.ToLower(os.Getenv("forward_mode")) {
+	case "", "direct":
+	case "gateway", "gateway-async":
+		forwardMode = strings.ToLower(os.Getenv("forward_mode"))
+	default:
+		logger.Warn("Invalid forward_mode", "forward_mode", os.Getenv("forward_mode"), "using", forwardMode)
+	}
+	if os.Getenv("gateway_url") != "" {
+		gatewayURL = os.Getenv("gateway_url")
+	}
+	parseTLS()
+	forwardTargets = parseTargets(os.Getenv("forward"))
+	routeTable := os.Getenv("routes")
+	if os.Getenv("routes_file") != "" {
+		content, err := ioutil.ReadFile(os.Getenv("routes_file"))
+		if err != nil {
+			logger.Panic("Cannot read routes file", "path", os.Getenv("routes_file"), "error", err)
+		}
+		routeTable = string(content)
+	}
+	var err error
+	routes, err = parseRoutes(routeTable)
+	if err != nil {
+		logger.Panic("Cannot parse routes", "error", err)
+	}
+	if routingEnabled() {
+		logger.Info("Routes provided, next function will be chosen based on the output")
+	} else if len(forwardTargets) == 0 {
+		logger.Info("No forward address provided, considering function as end of chain")
 		forwardEnable = false
 	}
-	forwardAddr = "http://" + forwardAddr + ":8080"
+	if len(forwardTargets) > 1 {
+		logger.Info("Multiple forward functions provided, output will be forwarded to all of them")
+	}
+	switch strings.ToLower(os.Getenv("fanout_aggregate")) {
+	case "":
+	case "json", "multipart":
+		fanoutAggregate = strings.ToLower(os.Getenv("fanout_aggregate"))
+	default:
+		logger.Warn("Invalid fanout_aggregate", "fanout_aggregate", os.Getenv("fanout_aggregate"), "using", fanoutAggregate)
+	}
+	switch strings.ToLower(os.Getenv("fanout_on_error")) {
+	case "":
+	case "abort", "partial", "ignore":
+		fanoutOnError = strings.ToLower(os.Getenv("fanout_on_error"))
+	default:
+		logger.Warn("Invalid fanout_on_error", "fanout_on_error", os.Getenv("fanout_on_error"), "using", fanoutOnError)
+	}
 	if strings.ToUpper(os.Getenv("async")) == "TRUE" {
-		log.Printf("Async flag is set, function won't wait for forward chain")
+		logger.Info("Async flag is set, function won't wait for forward chain")
 		async = true
 	}
 
@@ -273,37 +551,155 @@ func initialize() {
 			fileFormName = os.Getenv("file_form_name")
 		}
 	}
+	if serverTLS != nil && inputType == "POST" {
+		logger.Warn("TLS certificate provided on the head of the chain, the gateway and the http probes reach the function on plain http")
+	}
+
+	forwardHeaders = parseHeaderList(os.Getenv("forward_headers"))
+	chainTimeout = parseIntOrDurationValue(os.Getenv("chain_timeout"), 0)
+	callbackURL = os.Getenv("callback_url")
+	forwardSecret = parseForwardSecret(os.Getenv("forward_secret"))
+	signatureMaxAge = parseIntOrDurationValue(os.Getenv("signature_max_age"), 5*time.Minute)
+	if signingEnabled() {
+		logger.Info("Forward secret provided, forwarded requests will be signed and verified")
+	}
+	parseAuth()
+
+	traceEndpoint = parseTraceEndpoint()
+	traceServiceName = os.Getenv("trace_service_name")
+	if traceServiceName == "" {
+		traceServiceName = functionName
+	}
 
 	if os.Getenv("content_type") != "" {
 		contentType = os.Getenv("content_type")
 	}
+	parseErrorPolicy()
+
+	if os.Getenv("forward_workers") != "" {
+		workers, err := strconv.Atoi(os.Getenv("forward_workers"))
+		if err != nil || workers < 1 {
+			logger.Warn("Invalid forward_workers", "forward_workers", os.Getenv("forward_workers"), "using", forwardWorkers)
+		} else {
+			forwardWorkers = workers
+		}
+	}
+	queueDir = os.Getenv("queue_dir")
+	queueRetryInterval = parseIntOrDurationValue(os.Getenv("queue_retry_interval"), time.Second*5)
+	parseDeadLetter(os.Getenv("dead_letter"))
+	if strings.ToUpper(os.Getenv("dead_letter_replay")) == "TRUE" {
+		replayEnabled = true
+	}
+
+	if os.Getenv("forward_retries") != "" {
+		retries, err := strconv.Atoi(os.Getenv("forward_retries"))
+		if err != nil || retries < 0 {
+			logger.Warn("Invalid forward_retries, forward won't be retried", "forward_retries", os.Getenv("forward_retries"))
+		} else {
+			forwardRetries = retries
+		}
+	}
+	forwardBackoff = parseIntOrDurationValue(os.Getenv("forward_backoff"), time.Millisecond*100)
+	forwardMaxBackoff = parseIntOrDurationValue(os.Getenv("forward_max_backoff"), time.Second*10)
+	if os.Getenv("forward_retry_status") != "" {
+		forwardRetryStatus = parseStatusList(os.Getenv("forward_retry_status"))
+	}
+	rand.Seed(time.Now().UnixNano())
 
 	readTimeout = parseIntOrDurationValue(os.Getenv("read_timeout"), time.Second*5)
 	writeTimeout = parseIntOrDurationValue(os.Getenv("write_timeout"), time.Second*5)
+	execTimeout = parseIntOrDurationValue(os.Getenv("exec_timeout"), 0)
+
+	if os.Getenv("queue_size") != "" {
+		size, err := strconv.Atoi(os.Getenv("queue_size"))
+		if err != nil || size < 0 {
+			logger.Warn("Invalid queue_size", "queue_size", os.Getenv("queue_size"), "using", queueSize)
+		} else {
+			queueSize = size
+		}
+	}
+	requestQueue = make(chan *queuedRequest, queueSize)
+	switch strings.ToLower(os.Getenv("queue_overflow")) {
+	case "":
+	case "block", "reject", "spill":
+		queueOverflow = strings.ToLower(os.Getenv("queue_overflow"))
+	default:
+		logger.Warn("Invalid queue_overflow", "queue_overflow", os.Getenv("queue_overflow"), "using", queueOverflow)
+	}
+	queueBlockTimeout = parseIntOrDurationValue(os.Getenv("queue_block_timeout"), writeTimeout/2)
+	if os.Getenv("queue_reject_status") == "503" {
+		queueRejectStatus = http.StatusServiceUnavailable
+	}
+	queueRetryAfter = parseIntOrDurationValue(os.Getenv("queue_retry_after"), time.Second)
+	if os.Getenv("queue_spill_dir") != "" {
+		queueSpillDir = os.Getenv("queue_spill_dir")
+	}
+	statusRetention = parseIntOrDurationValue(os.Getenv("status_retention"), 10*time.Minute)
 }
 
 func main() {
 
 	initialize()
 
+	if traceEndpoint != "" {
+		go spanExporter()
+	}
+	if len(reloaders) > 0 {
+		go certWatcher()
+	}
+
 	// Start the forwarder queue if async request is needed
 	if async {
-		go forwarder()
+		if queuePersistent() {
+			err := os.MkdirAll(queueDir, 0700)
+			if err != nil {
+				logger.Panic("Cannot create queue directory", "path", queueDir, "error", err)
+			}
+			go replayQueue()
+		}
+		if queueOverflow == "spill" {
+			err := os.MkdirAll(queueSpillDir, 0700)
+			if err != nil {
+				logger.Panic("Cannot create spill directory", "path", queueSpillDir, "error", err)
+			}
+			// persisted requests are replayed from the queue directory
+			if queuePersistent() {
+				clearSpill()
+			} else {
+				countSpill()
+			}
+			go spillFeeder()
+		}
+		if deadLetterDir != "" {
+			err := os.MkdirAll(deadLetterDir, 0700)
+			if err != nil {
+				logger.Panic("Cannot create dead letter directory", "path", deadLetterDir, "error", err)
+			}
+		}
+		for i := 0; i < forwardWorkers; i++ {
+			go forwarder()
+		}
+		go statusPruner()
 	}
 
 	s := &http.Server{
 		Addr:         ":8080",
 		ReadTimeout:  readTimeout,
 		WriteTimeout: writeTimeout,
+		TLSConfig:    serverTLS,
 	}
 
 	// handle request with request handle
 	http.HandleFunc("/", reqHandle)
 	http.HandleFunc("/_/health", healthHandler)
+	http.HandleFunc("/_/metrics", metricsHandler)
+	http.HandleFunc("/_/replay", replayHandler)
+	http.HandleFunc("/_/queue", queueHandler)
+	http.HandleFunc("/_/status/", statusHandler)
 
 	path, writeErr := createLockFile()
 	if writeErr != nil {
-		log.Panicf("Cannot write %s\n Error: %s.\n", path, writeErr.Error())
+		logger.Panic("Cannot write lock-file", "path", path, "error", writeErr)
 	}
 
 	listenUntilShutdown(writeTimeout, s)
@@ -318,13 +714,13 @@ func listenUntilShutdown(shutdownTimeout time.Duration, s *http.Server) {
 
 		<-sig
 
-		log.Printf("SIGTERM received.. shutting down server")
+		logger.Info("SIGTERM received.. shutting down server")
 
 		acceptingConnections = false
 
 		if err := s.Shutdown(context.Background()); err != nil {
 			// Error from closing listeners, or context timeout:
-			log.Printf("Error in Shutdown: %v", err)
+			logger.Error("Error in Shutdown", "error", err)
 		}
 
 		<-time.Tick(shutdownTimeout)
@@ -332,8 +728,15 @@ func listenUntilShutdown(shutdownTimeout time.Duration, s *http.Server) {
 		close(idleConnsClosed)
 	}()
 
-	if err := s.ListenAndServe(); err != http.ErrServerClosed {
-		log.Printf("Error ListenAndServe: %v", err)
+	var err error
+	if s.TLSConfig != nil {
+		// the certificate is provided by the TLS config
+		err = s.ListenAndServeTLS("", "")
+	} else {
+		err = s.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		logger.Error("Error ListenAndServe", "error", err)
 		close(idleConnsClosed)
 	}
 
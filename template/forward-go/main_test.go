@@ -0,0 +1,56 @@
+package main
+
+import (
+	"flag"
+	"handler/sdk"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	// the function logs are only written in verbose mode
+	if !testing.Verbose() {
+		logger = sdk.NewLogger(sdk.LogText, ioutil.Discard)
+	}
+	os.Exit(m.Run())
+}
+
+func TestForwardStatus(t *testing.T) {
+	for _, tc := range []struct {
+		status    int
+		header    string
+		forwarded bool
+	}{
+		{http.StatusOK, "", true},
+		// a webhook or the async gateway accepting the request
+		{http.StatusCreated, "", true},
+		{http.StatusAccepted, "", true},
+		{http.StatusNoContent, "", true},
+		{http.StatusInternalServerError, "", false},
+		{http.StatusNotFound, "", false},
+		// the result of a function of the chain
+		{http.StatusBadRequest, "400", true},
+	} {
+		next := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ioutil.ReadAll(r.Body)
+			if tc.header != "" {
+				w.Header().Set(statusHeader, tc.header)
+			}
+			w.WriteHeader(tc.status)
+		}))
+		result, err := forward(&http.Client{}, next.URL, &requestMeta{ID: genRequestId()}, []byte("data"))
+		next.Close()
+		if tc.forwarded && (err != nil || result.status != tc.status) {
+			t.Errorf("expected status %d to be forwarded, error: %v", tc.status, err)
+		}
+		if !tc.forwarded {
+			if serr, ok := err.(*statusError); !ok || serr.code != tc.status {
+				t.Errorf("expected status %d to fail the forward, error: %v", tc.status, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// header carrying the ID of the request
+	requestIDHeader = "X-Forward-Request-Id"
+	// header carrying the position of the next function in the chain
+	hopHeader = "X-Forward-Hop"
+	// header carrying the address of the caller of the chain
+	originHeader = "X-Forward-Origin"
+	// header carrying the names of the headers propagated along the chain
+	headersHeader = "X-Forward-Headers"
+	// header marking a status set by a function of the chain
+	statusHeader = "X-Forward-Status"
+)
+
+var (
+	// allow-list of the headers propagated to the next function, a name
+	// ending with '*' matches every header with that prefix
+	forwardHeaders []string
+	// headers that are never propagated as they describe a single hop
+	hopHeaders = map[string]bool{
+		"Connection":        true,
+		"Content-Encoding":  true,
+		"Content-Length":    true,
+		"Content-Type":      true,
+		"Host":              true,
+		"Keep-Alive":        true,
+		"Te":                true,
+		"Trailer":           true,
+		"Transfer-Encoding": true,
+		"Upgrade":           true,
+	}
+)
+
+// requestMeta is the chain metadata of a request, it is carried to the
+// next function along with the data
+type requestMeta struct {
+	// ID of the request, shared by every function of the chain
+	ID string `json:"id"`
+	// Hop is the position of the function in the chain
+	Hop int `json:"hop"`
+	// ContentType of the data
+	ContentType string `json:"content_type,omitempty"`
+	// Origin is the address of the caller of the chain
+	Origin string `json:"origin,omitempty"`
+	// Header are the caller headers propagated along the chain
+	Header http.Header `json:"header,omitempty"`
+	// CallbackURL receives the result of an async chain
+	CallbackURL string `json:"callback_url,omitempty"`
+	// Async is set once the request went through an async function
+	Async bool `json:"async,omitempty"`
+	// TraceParent is the W3C trace context of the request
+	TraceParent string `json:"traceparent,omitempty"`
+	// TraceState is the W3C vendor trace state of the request
+	TraceState string `json:"tracestate,omitempty"`
+	// Deadline of the chain, zero if the chain has no time budget
+	Deadline time.Time `json:"deadline,omitempty"`
+	// Identity are the verified claims of the caller of the chain
+	Identity map[string]interface{} `json:"identity,omitempty"`
+	// Fallback is set when the input is forwarded to the fallback function
+	// of the failed handler, it isn't carried to the next function
+	Fallback bool `json:"fallback,omitempty"`
+	// Failure is the error of the failed handler, it is carried to the
+	// fallback function only
+	Failure *chainError `json:"failure,omitempty"`
+	// Targets are the functions a queued request is still to be forwarded
+	// to, all the next functions if empty. It isn't carried to the next
+	// function
+	Targets []string `json:"targets,omitempty"`
+}
+
+// parseHeaderList parses a comma separated list of header names
+func parseHeaderList(val string) []string {
+	var names []string
+	for _, name := range strings.Split(val, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if strings.HasSuffix(name, "*") {
+			names = append(names, strings.ToLower(name))
+			continue
+		}
+		names = append(names, http.CanonicalHeaderKey(name))
+	}
+	return names
+}
+
+// propagated checks if a header is in the allow-list
+func propagated(name string, allowed []string) bool {
+	if hopHeaders[name] || strings.HasPrefix(name, "X-Forward-") {
+		return false
+	}
+	for _, allow := range allowed {
+		if strings.HasSuffix(allow, "*") {
+			if strings.HasPrefix(strings.ToLower(name), strings.TrimSuffix(allow, "*")) {
+				return true
+			}
+		} else if allow == name {
+			return true
+		}
+	}
+	return false
+}
+
+// propagatedHeaders returns the headers of the request in the allow-list
+func propagatedHeaders(r *http.Request, allowed []string) http.Header {
+	header := make(http.Header)
+	for name, values := range r.Header {
+		if propagated(name, allowed) {
+			header[name] = values
+		}
+	}
+	return header
+}
+
+// callerAddr returns the address of the caller of a request
+func callerAddr(r *http.Request) string {
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// newMeta returns the chain metadata of a request received at the head
+// of the chain
+func newMeta(r *http.Request, requestID string) *requestMeta {
+	meta := &requestMeta{
+		ID:          requestID,
+		Origin:      callerAddr(r),
+		Header:      propagatedHeaders(r, forwardHeaders),
+		CallbackURL: r.Header.Get(callbackHeader),
+		TraceParent: r.Header.Get(traceParentHeader),
+		TraceState:  r.Header.Get(traceStateHeader),
+		Deadline:    chainDeadline(r),
+		Identity:    identityOf(r),
+	}
+	if meta.CallbackURL == "" {
+		meta.CallbackURL = callbackURL
+	}
+	return meta
+}
+
+// readMeta returns the chain metadata of a request forwarded by the
+// previous function, the headers listed by the previous function are
+// propagated along with the ones in the allow-list. Only the signed list is
+// propagated when the requests are signed
+func readMeta(r *http.Request, requestID string) *requestMeta {
+	if id := r.Header.Get(requestIDHeader); id != "" {
+		requestID = id
+	}
+	meta := &requestMeta{
+		ID:          requestID,
+		Origin:      r.Header.Get(originHeader),
+		CallbackURL: r.Header.Get(forwardCallbackHeader),
+		Async:       r.Header.Get(asyncHeader) == "true",
+		TraceParent: r.Header.Get(traceParentHeader),
+		TraceState:  r.Header.Get(traceStateHeader),
+		Deadline:    budgetDeadline(r),
+	}
+	// the identity is only trusted from a signed request, a forwarded
+	// request is verified by rejectUnsigned before its metadata is read
+	if signingEnabled() && inputType == "FILE" {
+		meta.Identity = decodeIdentity(r.Header.Get(identityHeader))
+	}
+	if meta.CallbackURL == "" {
+		meta.CallbackURL = callbackURL
+	}
+	if hop, err := strconv.Atoi(r.Header.Get(hopHeader)); err == nil && hop >= 0 {
+		meta.Hop = hop
+	}
+	allowed := parseHeaderList(r.Header.Get(headersHeader))
+	if !signingEnabled() {
+		allowed = append(allowed, forwardHeaders...)
+	}
+	meta.Header = propagatedHeaders(r, allowed)
+	return meta
+}
+
+// writeMeta sets the chain metadata on a request to the next function
+func writeMeta(req *http.Request, meta *requestMeta) {
+	names := make([]string, 0, len(meta.Header))
+	for name, values := range meta.Header {
+		req.Header[name] = values
+		names = append(names, name)
+	}
+	if len(names) > 0 {
+		sort.Strings(names)
+		req.Header.Set(headersHeader, strings.Join(names, ", "))
+	}
+	req.Header.Set(requestIDHeader, meta.ID)
+	req.Header.Set(hopHeader, strconv.Itoa(meta.Hop+1))
+	if meta.Origin != "" {
+		req.Header.Set(originHeader, meta.Origin)
+	}
+	if meta.CallbackURL != "" {
+		req.Header.Set(forwardCallbackHeader, meta.CallbackURL)
+	}
+	if meta.Async {
+		req.Header.Set(asyncHeader, "true")
+	}
+	if meta.TraceParent != "" {
+		req.Header.Set(traceParentHeader, meta.TraceParent)
+	}
+	if meta.TraceState != "" {
+		req.Header.Set(traceStateHeader, meta.TraceState)
+	}
+	if !meta.Deadline.IsZero() {
+		req.Header.Set(budgetHeader, remainingBudget(meta))
+	}
+	if meta.Failure != nil {
+		req.Header.Set(failureHeader, string(meta.Failure.encode()))
+	}
+	// the identity is only forwarded in a signed request
+	if len(meta.Identity) > 0 && signingEnabled() {
+		req.Header.Set(identityHeader, encodeIdentity(meta.Identity))
+	}
+}
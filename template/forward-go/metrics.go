@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	// buckets of the durations in seconds
+	durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+	// buckets of the payload sizes in bytes
+	sizeBuckets = []float64{256, 1024, 4096, 16384, 65536, 262144, 1048576, 4194304, 16777216}
+
+	requestsTotal = newCounterVec("faas_forward_requests_total",
+		"Requests received by input type.", "input_type")
+	handlerDuration = newHistogramVec("faas_forward_handler_duration_seconds",
+		"Duration of the function handler.", "", durationBuckets)
+	handlerErrors = newCounterVec("faas_forward_handler_errors_total",
+		"Requests the function handler failed to handle.", "")
+	handlerPanics = newCounterVec("faas_forward_handler_panics_total",
+		"Panics of the function handler.", "")
+	handlerTimeouts = newCounterVec("faas_forward_handler_timeouts_total",
+		"Requests the function handler didn't handle within exec_timeout.", "")
+	forwardAttempts = newCounterVec("faas_forward_forward_attempts_total",
+		"Attempts to forward a request by target.", "target")
+	forwardDuration = newHistogramVec("faas_forward_forward_duration_seconds",
+		"Latency of the forward attempts by target.", "target", durationBuckets)
+	forwardFailures = newCounterVec("faas_forward_forward_failures_total",
+		"Forward attempts that failed by target.", "target")
+	deadLetters = newCounterVec("faas_forward_dead_letters_total",
+		"Requests sent to the dead letter.", "")
+	requestSize = newHistogramVec("faas_forward_request_size_bytes",
+		"Size of the input of the function handler.", "", sizeBuckets)
+	responseSize = newHistogramVec("faas_forward_response_size_bytes",
+		"Size of the output of the function handler.", "", sizeBuckets)
+)
+
+// counterVec is a counter with an optional label
+type counterVec struct {
+	name   string
+	help   string
+	label  string
+	lock   sync.Mutex
+	values map[string]float64
+}
+
+func newCounterVec(name string, help string, label string) *counterVec {
+	return &counterVec{name: name, help: help, label: label, values: make(map[string]float64)}
+}
+
+// inc increments the counter of the label value
+func (c *counterVec) inc(labelValue string) {
+	c.lock.Lock()
+	c.values[labelValue]++
+	c.lock.Unlock()
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	if c.label == "" {
+		fmt.Fprintf(w, "%s %s\n", c.name, formatFloat(c.values[""]))
+		return
+	}
+	for _, value := range sortedLabels(c.values) {
+		fmt.Fprintf(w, "%s{%s} %s\n", c.name, formatLabel(c.label, value), formatFloat(c.values[value]))
+	}
+}
+
+// histogram is the distribution of the observed values of a label value
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// histogramVec is a histogram with an optional label
+type histogramVec struct {
+	name    string
+	help    string
+	label   string
+	buckets []float64
+	lock    sync.Mutex
+	series  map[string]*histogram
+}
+
+func newHistogramVec(name string, help string, label string, buckets []float64) *histogramVec {
+	return &histogramVec{name: name, help: help, label: label, buckets: buckets, series: make(map[string]*histogram)}
+}
+
+// observe adds a value to the histogram of the label value
+func (h *histogramVec) observe(labelValue string, value float64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	series, ok := h.series[labelValue]
+	if !ok {
+		series = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.series[labelValue] = series
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			series.counts[i]++
+		}
+	}
+	series.sum += value
+	series.count++
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	values := make([]string, 0, len(h.series))
+	for value := range h.series {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+	for _, value := range values {
+		series := h.series[value]
+		labels := ""
+		if h.label != "" {
+			labels = formatLabel(h.label, value) + ","
+		}
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket{%sle=\"%s\"} %d\n", h.name, labels, formatFloat(bound), series.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", h.name, labels, series.count)
+		labels = strings.TrimSuffix(labels, ",")
+		if labels != "" {
+			labels = "{" + labels + "}"
+		}
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, labels, formatFloat(series.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labels, series.count)
+	}
+}
+
+// writeGauge writes a gauge without label
+func writeGauge(w io.Writer, name string, help string, value float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", name, help, name, name, formatFloat(value))
+}
+
+// sortedLabels returns the label values of a counter in order
+func sortedLabels(values map[string]float64) []string {
+	labels := make([]string, 0, len(values))
+	for value := range values {
+		labels = append(labels, value)
+	}
+	sort.Strings(labels)
+	return labels
+}
+
+// formatLabel formats a label pair escaping the value
+func formatLabel(name string, value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, `"`, `\"`, -1)
+	value = strings.Replace(value, "\n", `\n`, -1)
+	return fmt.Sprintf(`%s="%s"`, name, value)
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// handle metrics request in the prometheus text format
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		bw := bufio.NewWriter(w)
+		requestsTotal.write(bw)
+		handlerDuration.write(bw)
+		handlerErrors.write(bw)
+		handlerPanics.write(bw)
+		handlerTimeouts.write(bw)
+		requestSize.write(bw)
+		responseSize.write(bw)
+		forwardAttempts.write(bw)
+		forwardDuration.write(bw)
+		forwardFailures.write(bw)
+		if async {
+			writeGauge(bw, "faas_forward_queue_depth", "Requests waiting in the async queue.", float64(len(requestQueue)))
+			writeGauge(bw, "faas_forward_queue_capacity", "Capacity of the async queue.", float64(cap(requestQueue)))
+			writeGauge(bw, "faas_forward_queue_spilled", "Requests waiting in the spill directory.", float64(atomic.LoadInt64(&spilled)))
+			deadLetters.write(bw)
+		}
+		bw.Flush()
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
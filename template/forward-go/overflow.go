@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	queueSize         = 10
+	queueOverflow     = "block"
+	queueBlockTimeout time.Duration
+	queueRejectStatus = http.StatusTooManyRequests
+	queueRetryAfter   = time.Second
+	queueSpillDir     = "/tmp/spill"
+	// number of requests waiting in the spill directory
+	spilled int64
+	// wakes up the spill feeder when a request is spilled
+	spillNotify = make(chan struct{}, 1)
+)
+
+// queueFullError is returned when a request can't be put on the full queue
+type queueFullError struct {
+	retryAfter time.Duration
+}
+
+func (err *queueFullError) Error() string {
+	return fmt.Sprintf("request queue is full (%d requests)", queueSize)
+}
+
+// pushRequest puts a request on the request queue as per the overflow
+// policy when the queue is full
+func pushRequest(queued *queuedRequest) error {
+	// keep the order of the requests while some are spilled
+	if queueOverflow == "spill" && atomic.LoadInt64(&spilled) > 0 {
+		return spillRequest(queued)
+	}
+
+	select {
+	case requestQueue <- queued:
+		return nil
+	default:
+	}
+
+	switch queueOverflow {
+	case "reject":
+		return &queueFullError{retryAfter: queueRetryAfter}
+	case "spill":
+		return spillRequest(queued)
+	}
+
+	timer := time.NewTimer(queueBlockTimeout)
+	defer timer.Stop()
+	select {
+	case requestQueue <- queued:
+		return nil
+	case <-timer.C:
+		return &queueFullError{retryAfter: queueRetryAfter}
+	}
+}
+
+// spillRequest writes a request to the spill directory, it is put on the
+// queue by the spill feeder once there is room
+func spillRequest(queued *queuedRequest) error {
+	content, err := encodeRequest(queued.meta, queued.data)
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%019d-%s%s", time.Now().UnixNano(), filepath.Base(queued.key), reqExt)
+	err = writeFileSync(filepath.Join(queueSpillDir, name), content)
+	if err != nil {
+		return err
+	}
+	atomic.AddInt64(&spilled, 1)
+	select {
+	case spillNotify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// spillFeeder puts the spilled requests on the request queue once they are
+// spilled
+func spillFeeder() {
+	for {
+		feedSpilled()
+		<-spillNotify
+	}
+}
+
+// feedSpilled puts the requests of the spill directory on the request
+// queue in the order they were spilled, blocking until there is room
+func feedSpilled() {
+	files, err := ioutil.ReadDir(queueSpillDir)
+	if err != nil {
+		logger.Error("failed to read spill directory", "path", queueSpillDir, "error", err)
+	}
+	var names []string
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), reqExt) {
+			names = append(names, file.Name())
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		path := filepath.Join(queueSpillDir, name)
+		content, err := ioutil.ReadFile(path)
+		if err == nil {
+			var queued *queuedRequest
+			queued, err = decodeRequest(content)
+			if err == nil {
+				// the name is the spill time followed by the key
+				queued.key = strings.TrimSuffix(name[20:], reqExt)
+				requestQueue <- queued
+			}
+		}
+		if err != nil {
+			logger.Error("failed to load spilled request", "file", name, "error", err)
+		}
+		os.Remove(path)
+		atomic.AddInt64(&spilled, -1)
+	}
+}
+
+// clearSpill removes the requests spilled by a previous run, they are
+// replayed from the persistent queue
+func clearSpill() {
+	files, _ := ioutil.ReadDir(queueSpillDir)
+	for _, file := range files {
+		os.Remove(filepath.Join(queueSpillDir, file.Name()))
+	}
+}
+
+// countSpill counts the requests spilled by a previous run
+func countSpill() {
+	files, _ := ioutil.ReadDir(queueSpillDir)
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), reqExt) {
+			atomic.AddInt64(&spilled, 1)
+		}
+	}
+}
+
+// rejectRequest replies with the error envelope to a request that can't be
+// queued
+func rejectRequest(w http.ResponseWriter, meta *requestMeta, err *queueFullError) {
+	seconds := int((err.retryAfter + time.Second - 1) / time.Second)
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	writeError(w, meta, queueRejectStatus, err.Error())
+}
+
+// queueStatus is the state of the request queue
+type queueStatus struct {
+	Depth    int    `json:"depth"`
+	Capacity int    `json:"capacity"`
+	Spilled  int64  `json:"spilled"`
+	Workers  int    `json:"workers"`
+	Overflow string `json:"overflow"`
+}
+
+// handle queue depth request
+func queueHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		status := queueStatus{
+			Depth:    len(requestQueue),
+			Capacity: cap(requestQueue),
+			Spilled:  atomic.LoadInt64(&spilled),
+			Workers:  forwardWorkers,
+			Overflow: queueOverflow,
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newQueued returns a new message of a request to put on the queue
+func newQueued() *queuedRequest {
+	requestID := genRequestId()
+	return &queuedRequest{key: messageKey(requestID), meta: &requestMeta{ID: requestID}, data: []byte(requestID)}
+}
+
+func TestRejectRequest(t *testing.T) {
+	w := httptest.NewRecorder()
+	meta := &requestMeta{ID: genRequestId(), Hop: 1}
+	rejectRequest(w, meta, &queueFullError{retryAfter: 1500 * time.Millisecond})
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "2" {
+		t.Errorf("unexpected reply %d, retry after '%s'", w.Code, w.Header().Get("Retry-After"))
+	}
+	envelope := &errorEnvelope{}
+	if err := json.Unmarshal(w.Body.Bytes(), envelope); err != nil || envelope.Error == nil {
+		t.Fatalf("expected the error envelope, error: %v", err)
+	}
+	if w.Header().Get(chainErrorHeader) != "1" || envelope.Error.Status != http.StatusTooManyRequests || envelope.Error.RequestID != meta.ID {
+		t.Errorf("unexpected chain error %+v", envelope.Error)
+	}
+}
+
+func TestBlockOverflow(t *testing.T) {
+	defer setupQueue(t, 1)()
+	saved := queueBlockTimeout
+	queueOverflow, queueBlockTimeout = "block", 50*time.Millisecond
+	defer func() { queueBlockTimeout = saved }()
+
+	if err := pushRequest(newQueued()); err != nil {
+		t.Fatalf("failed to push request, error: %v", err)
+	}
+
+	// the full queue is waited for until the timeout
+	start := time.Now()
+	err := pushRequest(newQueued())
+	if _, ok := err.(*queueFullError); !ok {
+		t.Fatalf("expected the queue to be full, error: %v", err)
+	}
+	if waited := time.Since(start); waited < queueBlockTimeout {
+		t.Errorf("expected to wait %s for the queue, waited %s", queueBlockTimeout, waited)
+	}
+
+	// a request is queued once there is room
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		<-requestQueue
+	}()
+	queued := newQueued()
+	if err := pushRequest(queued); err != nil {
+		t.Fatalf("expected the request to be queued once there is room, error: %v", err)
+	}
+	if next := <-requestQueue; next.key != queued.key {
+		t.Errorf("unexpected request on the queue '%s'", next.key)
+	}
+}
+
+func TestSpillOverflow(t *testing.T) {
+	defer setupQueue(t, 1)()
+	dir, err := ioutil.TempDir("", "spill")
+	if err != nil {
+		t.Fatalf("failed to create spill directory, error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	saved := queueSpillDir
+	queueOverflow, queueSpillDir = "spill", dir
+	defer func() { queueSpillDir = saved }()
+	defer func() {
+		select {
+		case <-spillNotify:
+		default:
+		}
+	}()
+
+	pushed := make([]*queuedRequest, 6)
+	for i := range pushed[:5] {
+		pushed[i] = newQueued()
+		if err := pushRequest(pushed[i]); err != nil {
+			t.Fatalf("failed to push request, error: %v", err)
+		}
+	}
+	if count := atomic.LoadInt64(&spilled); count != 4 || len(requestQueue) != 1 {
+		t.Fatalf("expected 4 requests to be spilled, got %d with %d queued", count, len(requestQueue))
+	}
+
+	// a request is spilled while others wait in the spill directory, even
+	// if there is room on the queue
+	if first := <-requestQueue; first.key != pushed[0].key {
+		t.Errorf("unexpected request on the queue '%s'", first.key)
+	}
+	pushed[5] = newQueued()
+	if err := pushRequest(pushed[5]); err != nil {
+		t.Fatalf("failed to push request, error: %v", err)
+	}
+	if len(requestQueue) != 0 {
+		t.Fatal("expected the request to be spilled after the others")
+	}
+
+	// the spilled requests are queued in order
+	done := make(chan struct{})
+	go func() {
+		feedSpilled()
+		close(done)
+	}()
+	for _, expected := range pushed[1:] {
+		queued := <-requestQueue
+		if queued.key != expected.key || queued.meta.ID != expected.meta.ID || string(queued.data) != expected.meta.ID {
+			t.Errorf("expected request '%s', got '%s'", expected.key, queued.key)
+		}
+	}
+	<-done
+	files, _ := ioutil.ReadDir(dir)
+	if count := atomic.LoadInt64(&spilled); count != 0 || len(files) != 0 {
+		t.Errorf("expected the spill directory to be empty, %d spilled and %d files", count, len(files))
+	}
+}
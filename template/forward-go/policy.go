@@ -0,0 +1,77 @@
+package main
+
+import (
+	"handler/sdk"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+var (
+	// onError is the policy applied when the handler fails, 'abort' ends
+	// the chain with an error, 'skip' forwards the input of the function,
+	// 'fallback' forwards the input to the fallback function instead and
+	// 'default' forwards the default output
+	onError = "abort"
+	// onErrorFallback is the function the input is forwarded to when the
+	// handler fails with the 'fallback' policy
+	onErrorFallback []*target
+	// onErrorDefault is the output of the function when the handler fails
+	// with the 'default' policy
+	onErrorDefault []byte
+	// onErrorContentType is the content type of the default output
+	onErrorContentType string
+)
+
+// parseErrorPolicy reads the error policy of the function
+func parseErrorPolicy() {
+	switch strings.ToLower(os.Getenv("on_error")) {
+	case "", "abort":
+	case "skip":
+		onError = "skip"
+	case "fallback":
+		onErrorFallback = parseTargets(os.Getenv("on_error_fallback"))
+		if len(onErrorFallback) == 0 {
+			logger.Warn("No on_error_fallback function provided, using abort", "on_error", "fallback")
+			return
+		}
+		onError = "fallback"
+	case "default":
+		onError = "default"
+		onErrorDefault = []byte(os.Getenv("on_error_default"))
+		if path := os.Getenv("on_error_default_file"); path != "" {
+			content, err := ioutil.ReadFile(path)
+			if err != nil {
+				logger.Panic("Cannot read on_error_default_file", "path", path, "error", err)
+			}
+			onErrorDefault = content
+		}
+		onErrorContentType = os.Getenv("on_error_content_type")
+		if onErrorContentType == "" {
+			onErrorContentType = contentType
+		}
+	default:
+		logger.Warn("Invalid on_error, using abort", "on_error", os.Getenv("on_error"))
+	}
+}
+
+// errorResponse returns the output of the function as per the error policy
+// when the handler fails, nil if the chain is aborted
+func errorResponse(input []byte, inputContentType string) *sdk.Response {
+	switch onError {
+	case "skip", "fallback":
+		return &sdk.Response{Body: input, ContentType: inputContentType}
+	case "default":
+		return &sdk.Response{Body: onErrorDefault, ContentType: onErrorContentType}
+	}
+	return nil
+}
+
+// forwardTargetsOf returns the functions the output of a request is
+// forwarded to
+func forwardTargetsOf(meta *requestMeta, data []byte) []*target {
+	if meta.Fallback {
+		return onErrorFallback
+	}
+	return nextTargets(data, meta.ContentType)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// setupErrorPolicy sets the env, the returned function restores the
+// error policy
+func setupErrorPolicy(env map[string]string) func() {
+	saved := []interface{}{onError, onErrorFallback, onErrorDefault, onErrorContentType}
+	onError, onErrorFallback, onErrorDefault, onErrorContentType = "abort", nil, nil, ""
+	for key, val := range env {
+		os.Setenv(key, val)
+	}
+	return func() {
+		for key := range env {
+			os.Unsetenv(key)
+		}
+		onError = saved[0].(string)
+		onErrorFallback = saved[1].([]*target)
+		onErrorDefault = saved[2].([]byte)
+		onErrorContentType = saved[3].(string)
+	}
+}
+
+func TestErrorPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "policy")
+	if err != nil {
+		t.Fatalf("failed to create directory, error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	defaultFile := filepath.Join(dir, "default.json")
+	ioutil.WriteFile(defaultFile, []byte(`{"from":"file"}`), 0600)
+
+	input, inputType := []byte("input"), "text/plain"
+	for _, tc := range []struct {
+		name     string
+		env      map[string]string
+		policy   string
+		body     string
+		respType string
+	}{
+		{"abort by default", map[string]string{}, "abort", "", ""},
+		{"invalid", map[string]string{"on_error": "retry"}, "abort", "", ""},
+		{"skip", map[string]string{"on_error": "skip"}, "skip", "input", "text/plain"},
+		{"fallback", map[string]string{"on_error": "Fallback", "on_error_fallback": "recover"}, "fallback", "input", "text/plain"},
+		{"fallback without function", map[string]string{"on_error": "fallback"}, "abort", "", ""},
+		{"default", map[string]string{"on_error": "default", "on_error_default": `{"ok":false}`, "on_error_content_type": "application/json"}, "default", `{"ok":false}`, "application/json"},
+		{"default file", map[string]string{"on_error": "default", "on_error_default": "ignored", "on_error_default_file": defaultFile}, "default", `{"from":"file"}`, contentType},
+	} {
+		restore := setupErrorPolicy(tc.env)
+		parseErrorPolicy()
+		resp := errorResponse(input, inputType)
+		switch {
+		case onError != tc.policy:
+			t.Errorf("%s: expected policy '%s', got '%s'", tc.name, tc.policy, onError)
+		case tc.policy == "abort" && resp != nil:
+			t.Errorf("%s: expected the chain to be aborted", tc.name)
+		case tc.policy != "abort" && (resp == nil || string(resp.Body) != tc.body || resp.ContentType != tc.respType):
+			t.Errorf("%s: expected output '%s' of type '%s', got %+v", tc.name, tc.body, tc.respType, resp)
+		}
+		restore()
+	}
+}
+
+func TestFallbackReceivesFailure(t *testing.T) {
+	type received struct {
+		data    string
+		failure string
+	}
+	fallback := make(chan received, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		file, _, err := r.FormFile(fileFormName)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		data, _ := ioutil.ReadAll(file)
+		fallback <- received{data: string(data), failure: r.Header.Get(failureHeader)}
+	}))
+	defer server.Close()
+	defer setupErrorPolicy(map[string]string{"on_error": "fallback", "on_error_fallback": server.URL})()
+	parseErrorPolicy()
+	savedRoutes, savedTargets := routes, forwardTargets
+	defer func() { routes, forwardTargets = savedRoutes, savedTargets }()
+	routes, forwardTargets = nil, parseTargets("next")
+
+	// the input of the failed handler is forwarded to the fallback only
+	meta := &requestMeta{ID: genRequestId(), Hop: 2}
+	if targets := targetNames(forwardTargetsOf(meta, []byte("input"))); targets != "next" {
+		t.Errorf("expected the next function without failure, got '%s'", targets)
+	}
+	meta.Fallback = true
+	meta.Failure = newChainError(meta, handlerErrorStatus(errors.New("boom")), "Failed to handle request: boom")
+	targets := forwardTargetsOf(meta, []byte("input"))
+	if len(targets) != 1 || targets[0].addr != server.URL {
+		t.Fatalf("expected the fallback function, got '%s'", targetNames(targets))
+	}
+
+	if _, _, err := forwardWithRetry(forwardClient(), targets[0].addr, meta, []byte("input")); err != nil {
+		t.Fatalf("failed to forward to the fallback, error: %v", err)
+	}
+	got := <-fallback
+	if got.data != "input" {
+		t.Errorf("expected the input of the failed handler, got '%s'", got.data)
+	}
+	envelope := &errorEnvelope{}
+	if err := json.Unmarshal([]byte(got.failure), envelope); err != nil || envelope.Error == nil {
+		t.Fatalf("expected the error envelope of the failure, got '%s'", got.failure)
+	}
+	if envelope.Error.Hop != 2 || envelope.Error.Status != http.StatusInternalServerError ||
+		envelope.Error.Message != "Failed to handle request: boom" || envelope.Error.RequestID != meta.ID {
+		t.Errorf("unexpected failure %+v", envelope.Error)
+	}
+
+	// the failure isn't carried past the fallback
+	r := httptest.NewRequest(http.MethodPost, "/", nil)
+	writeMeta(r, meta)
+	if next := readMeta(r, ""); next.Failure != nil || next.Fallback {
+		t.Error("expected the failure not to be read by the fallback as its own")
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// extension of a persisted request in the queue directory
+	reqExt = ".req"
+	// extension of a request being written to the queue directory
+	tmpExt = ".tmp"
+)
+
+var (
+	queueDir           string
+	queueRetryInterval time.Duration
+)
+
+// queuePersistent checks if async requests are persisted on disk
+func queuePersistent() bool {
+	return queueDir != ""
+}
+
+// requestPath returns the path of a persisted request
+func requestPath(key string) string {
+	return filepath.Join(queueDir, filepath.Base(key)+reqExt)
+}
+
+// queuedRequest is a request waiting to be forwarded, it is passed to the
+// forwarders through the request queue
+type queuedRequest struct {
+	// key of the message in the function, a function can receive the
+	// same request ID several times along the branches of a chain
+	key  string
+	meta *requestMeta
+	data []byte
+}
+
+// messageKey returns a key unique to a message of the request, the request
+// ID only correlates the messages of a request
+func messageKey(requestID string) string {
+	return filepath.Base(requestID) + "_" + genRequestId()
+}
+
+// enqueueRequest puts a request on the request queue, when the queue is
+// persistent the data is on disk before the request is accepted
+func enqueueRequest(meta *requestMeta, data []byte) error {
+	meta.Async = true
+	queued := &queuedRequest{key: messageKey(meta.ID), meta: meta, data: data}
+	err := storeRequest(queued)
+	if err != nil {
+		return err
+	}
+	setStatus(queued.key, meta.ID, statusQueued, nil)
+	err = pushRequest(queued)
+	if err != nil {
+		// a rejected request is not kept
+		forgetStatus(queued.key)
+		deleteRequest(queued.key)
+	}
+	return err
+}
+
+// encodeRequest encodes a request to be written on disk, the json encoded
+// metadata on the first line followed by the data
+func encodeRequest(meta *requestMeta, data []byte) ([]byte, error) {
+	encoded, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	b.Write(encoded)
+	b.WriteByte('\n')
+	b.Write(data)
+	return b.Bytes(), nil
+}
+
+// decodeRequest decodes a request written on disk
+func decodeRequest(content []byte) (*queuedRequest, error) {
+	index := bytes.IndexByte(content, '\n')
+	if index < 0 {
+		return nil, fmt.Errorf("no metadata in persisted request")
+	}
+	meta := &requestMeta{}
+	err := json.Unmarshal(content[:index], meta)
+	if err != nil {
+		return nil, fmt.Errorf("invalid metadata in persisted request, error: %v", err)
+	}
+	return &queuedRequest{meta: meta, data: content[index+1:]}, nil
+}
+
+// storeRequest persists the request data until it is forwarded when the
+// queue is persistent
+func storeRequest(queued *queuedRequest) error {
+	if !queuePersistent() {
+		return nil
+	}
+
+	content, err := encodeRequest(queued.meta, queued.data)
+	if err != nil {
+		return err
+	}
+	return writeFileSync(requestPath(queued.key), content)
+}
+
+// writeFileSync atomically writes data to path and flushes it to disk
+func writeFileSync(path string, data []byte) error {
+	tmp := path + tmpExt
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	// rename is atomic, a request is either fully persisted or absent
+	err = os.Rename(tmp, path)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// loadRequest returns a persisted request
+func loadRequest(key string) (*queuedRequest, error) {
+	content, err := ioutil.ReadFile(requestPath(key))
+	if err != nil {
+		return nil, err
+	}
+	queued, err := decodeRequest(content)
+	if err != nil {
+		return nil, err
+	}
+	queued.key = key
+	return queued, nil
+}
+
+// deleteRequest removes the persisted data of a request, it must only be
+// called once the request is acknowledged by the next function
+func deleteRequest(key string) {
+	if !queuePersistent() {
+		return
+	}
+	err := os.Remove(requestPath(key))
+	if err != nil && !os.IsNotExist(err) {
+		logger.Error("failed to remove request from queue", "key", key, "error", err)
+	}
+}
+
+// pendingTargets returns the targets a queued request is still to be
+// forwarded to, a requeued or replayed request only goes to the targets it
+// failed to reach
+func pendingTargets(meta *requestMeta, data []byte) []*target {
+	if len(meta.Targets) == 0 {
+		return forwardTargetsOf(meta, data)
+	}
+	targets := make([]*target, 0, len(meta.Targets))
+	for _, name := range meta.Targets {
+		targets = append(targets, &target{name: name, addr: targetAddr(name)})
+	}
+	return targets
+}
+
+// requeueRequest puts a request that failed to be forwarded back on the
+// request queue after the retry interval
+func requeueRequest(queued *queuedRequest) {
+	wait, queue := queueRetryInterval, requestQueue
+	go func() {
+		time.Sleep(wait)
+		queue <- queued
+	}()
+}
+
+// replayQueue puts the requests persisted by a previous run on the
+// request queue in the order they were received
+func replayQueue() {
+	files, err := ioutil.ReadDir(queueDir)
+	if err != nil {
+		logger.Error("failed to read queue directory", "path", queueDir, "error", err)
+		return
+	}
+
+	var requests []os.FileInfo
+	for _, file := range files {
+		switch {
+		case strings.HasSuffix(file.Name(), tmpExt):
+			// the request was never accepted
+			os.Remove(filepath.Join(queueDir, file.Name()))
+		case strings.HasSuffix(file.Name(), reqExt):
+			requests = append(requests, file)
+		}
+	}
+	sort.Slice(requests, func(i, j int) bool {
+		return requests[i].ModTime().Before(requests[j].ModTime())
+	})
+
+	if len(requests) > 0 {
+		logger.Info("replaying requests from queue directory", "path", queueDir, "requests", len(requests))
+	}
+	for _, file := range requests {
+		key := strings.TrimSuffix(file.Name(), reqExt)
+		queued, err := loadRequest(key)
+		if err != nil {
+			logger.Error("failed to load the request from queue", "key", key, "error", err)
+			continue
+		}
+		setStatus(key, queued.meta.ID, statusQueued, nil)
+		requestQueue <- queued
+	}
+}
+
+// syncDir flushes the directory entries to disk
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
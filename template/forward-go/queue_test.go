@@ -0,0 +1,314 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recorder is a next function recording the IDs of the requests it
+// receives, the first failures requests of each ID fail with 502
+type recorder struct {
+	failures int
+	lock     sync.Mutex
+	received map[string]int
+}
+
+func newRecorder(failures int) (*recorder, *httptest.Server) {
+	rec := &recorder{failures: failures, received: make(map[string]int)}
+	return rec, httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		requestID := r.Header.Get(requestIDHeader)
+		rec.lock.Lock()
+		rec.received[requestID]++
+		fail := rec.received[requestID] <= rec.failures
+		rec.lock.Unlock()
+		if fail {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+}
+
+// count returns the number of requests received for the request ID
+func (rec *recorder) count(requestID string) int {
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+	return rec.received[requestID]
+}
+
+// setupQueue configures an async function forwarding to the addresses
+// with a persistent queue, the returned function restores the config
+func setupQueue(t *testing.T, size int, addrs ...string) func() {
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatalf("failed to create queue directory, error: %v", err)
+	}
+	saved := []interface{}{async, forwardEnable, forwardTargets, requestQueue, queueDir, queueRetryInterval, queueOverflow, forwardRetries}
+	async, forwardEnable = true, true
+	forwardTargets = nil
+	for _, addr := range addrs {
+		forwardTargets = append(forwardTargets, &target{name: addr, addr: addr})
+	}
+	requestQueue = make(chan *queuedRequest, size)
+	queueDir = dir
+	queueRetryInterval = 10 * time.Millisecond
+	queueOverflow = "reject"
+	forwardRetries = 0
+	return func() {
+		async, forwardEnable = saved[0].(bool), saved[1].(bool)
+		forwardTargets = saved[2].([]*target)
+		requestQueue = saved[3].(chan *queuedRequest)
+		queueDir = saved[4].(string)
+		queueRetryInterval = saved[5].(time.Duration)
+		queueOverflow = saved[6].(string)
+		forwardRetries = saved[7].(int)
+		os.RemoveAll(dir)
+	}
+}
+
+// persisted returns the keys of the persisted messages of the request
+func persisted(t *testing.T, requestID string) []string {
+	paths, err := filepath.Glob(filepath.Join(queueDir, requestID+"_*"+reqExt))
+	if err != nil {
+		t.Fatalf("failed to list queue directory, error: %v", err)
+	}
+	keys := make([]string, 0, len(paths))
+	for _, path := range paths {
+		keys = append(keys, strings.TrimSuffix(filepath.Base(path), reqExt))
+	}
+	return keys
+}
+
+// waitStatus waits for the request to reach the status
+func waitStatus(t *testing.T, requestID string, status string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if state, ok := getStatus(requestID); ok && state.Status == status {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	state, _ := getStatus(requestID)
+	t.Fatalf("request '%s' is '%s', expected '%s'", requestID, state.Status, status)
+}
+
+func TestEnqueueRequest(t *testing.T) {
+	defer setupQueue(t, 1, "http://127.0.0.1:1/")()
+
+	meta := &requestMeta{ID: genRequestId()}
+	if err := enqueueRequest(meta, []byte("data")); err != nil {
+		t.Fatalf("failed to enqueue request, error: %v", err)
+	}
+	if !meta.Async {
+		t.Error("expected the request to be marked async")
+	}
+	if state, ok := getStatus(meta.ID); !ok || state.Status != statusQueued {
+		t.Errorf("unexpected status %+v", state)
+	}
+	keys := persisted(t, meta.ID)
+	if len(keys) != 1 {
+		t.Fatalf("expected the request to be persisted once, got %v", keys)
+	}
+	queued, err := loadRequest(keys[0])
+	if err != nil || string(queued.data) != "data" || queued.meta.ID != meta.ID {
+		t.Fatalf("request is not persisted as expected, error: %v", err)
+	}
+
+	// the queue is full, the request is rejected and not kept
+	rejected := &requestMeta{ID: genRequestId()}
+	if err := enqueueRequest(rejected, []byte("data")); err == nil {
+		t.Fatal("expected the request to be rejected")
+	}
+	if _, ok := getStatus(rejected.ID); ok {
+		t.Error("expected the status of the rejected request to be forgotten")
+	}
+	if keys := persisted(t, rejected.ID); len(keys) != 0 {
+		t.Error("expected the rejected request not to be persisted")
+	}
+	if queued := <-requestQueue; queued.meta.ID != meta.ID || queued.key != keys[0] {
+		t.Errorf("unexpected request '%s' on the queue", queued.key)
+	}
+}
+
+func TestForwarders(t *testing.T) {
+	rec, next := newRecorder(0)
+	defer next.Close()
+	defer setupQueue(t, 100, next.URL)()
+	for i := 0; i < 4; i++ {
+		go forwarder()
+	}
+
+	// requests are enqueued concurrently and consumed by every forwarder
+	var wg sync.WaitGroup
+	ids := make([]string, 50)
+	for i := range ids {
+		ids[i] = genRequestId()
+		wg.Add(1)
+		go func(requestID string) {
+			defer wg.Done()
+			if err := enqueueRequest(&requestMeta{ID: requestID}, []byte(requestID)); err != nil {
+				t.Errorf("failed to enqueue request, error: %v", err)
+			}
+		}(ids[i])
+	}
+	wg.Wait()
+
+	for _, requestID := range ids {
+		waitStatus(t, requestID, statusDelivered)
+		if count := rec.count(requestID); count != 1 {
+			t.Errorf("request '%s' forwarded %d times", requestID, count)
+		}
+		if keys := persisted(t, requestID); len(keys) != 0 {
+			t.Errorf("expected delivered request '%s' to be removed from the queue", requestID)
+		}
+	}
+}
+
+func TestRequeue(t *testing.T) {
+	ok, okNext := newRecorder(0)
+	defer okNext.Close()
+	failing, failingNext := newRecorder(2)
+	defer failingNext.Close()
+	defer setupQueue(t, 10, okNext.URL, failingNext.URL)()
+	go forwarder()
+
+	meta := &requestMeta{ID: genRequestId()}
+	if err := enqueueRequest(meta, []byte("data")); err != nil {
+		t.Fatalf("failed to enqueue request, error: %v", err)
+	}
+	waitStatus(t, meta.ID, statusDelivered)
+
+	// only the failed branch of the fan-out is retried
+	if count := ok.count(meta.ID); count != 1 {
+		t.Errorf("succeeded target received the request %d times", count)
+	}
+	if count := failing.count(meta.ID); count != 3 {
+		t.Errorf("failed target received the request %d times, expected 3", count)
+	}
+	if keys := persisted(t, meta.ID); len(keys) != 0 {
+		t.Error("expected delivered request to be removed from the queue")
+	}
+}
+
+func TestRequeuePersistsPendingTargets(t *testing.T) {
+	_, okNext := newRecorder(0)
+	defer okNext.Close()
+	_, failingNext := newRecorder(1)
+	defer failingNext.Close()
+	defer setupQueue(t, 10, okNext.URL, failingNext.URL)()
+
+	meta := &requestMeta{ID: genRequestId()}
+	if err := enqueueRequest(meta, []byte("data")); err != nil {
+		t.Fatalf("failed to enqueue request, error: %v", err)
+	}
+	forwardQueued(<-requestQueue)
+
+	// the request is back on the queue and persisted with the failed
+	// target only
+	requeued := <-requestQueue
+	if len(requeued.meta.Targets) != 1 || requeued.meta.Targets[0] != failingNext.URL {
+		t.Errorf("unexpected pending targets %v", requeued.meta.Targets)
+	}
+	stored, err := loadRequest(requeued.key)
+	if err != nil {
+		t.Fatalf("failed to load the requeued request, error: %v", err)
+	}
+	if len(stored.meta.Targets) != 1 || stored.meta.Targets[0] != failingNext.URL {
+		t.Errorf("unexpected persisted targets %v", stored.meta.Targets)
+	}
+	if state, _ := getStatus(meta.ID); state.Status != statusQueued || state.Error == "" {
+		t.Errorf("unexpected status %+v", state)
+	}
+}
+
+func TestStatusHandler(t *testing.T) {
+	requestID := genRequestId()
+	key := messageKey(requestID)
+	setStatus(key, requestID, statusFailed, fmt.Errorf("bad status: 502 Bad Gateway"))
+	defer forgetStatus(key)
+
+	w := httptest.NewRecorder()
+	statusHandler(w, httptest.NewRequest(http.MethodGet, "/_/status/"+requestID, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", w.Code)
+	}
+	state := &requestStatus{}
+	if err := json.Unmarshal(w.Body.Bytes(), state); err != nil {
+		t.Fatalf("invalid status body, error: %v", err)
+	}
+	if state.RequestID != requestID || state.Status != statusFailed || state.Error != "bad status: 502 Bad Gateway" {
+		t.Errorf("unexpected status %+v", state)
+	}
+
+	w = httptest.NewRecorder()
+	statusHandler(w, httptest.NewRequest(http.MethodGet, "/_/status/unknown", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown request, got %d", w.Code)
+	}
+}
+
+func TestSameRequestID(t *testing.T) {
+	var lock sync.Mutex
+	var received []string
+	next := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		file, _, err := r.FormFile(fileFormName)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		data, _ := ioutil.ReadAll(file)
+		lock.Lock()
+		received = append(received, string(data))
+		lock.Unlock()
+	}))
+	defer next.Close()
+	defer setupQueue(t, 10, next.URL)()
+
+	// the request reaches the function along two branches of the chain
+	requestID := genRequestId()
+	for _, data := range []string{"first", "second"} {
+		if err := enqueueRequest(&requestMeta{ID: requestID, Hop: 2}, []byte(data)); err != nil {
+			t.Fatalf("failed to enqueue request, error: %v", err)
+		}
+	}
+	first, second := <-requestQueue, <-requestQueue
+	if first.key == second.key {
+		t.Fatalf("expected the messages to have their own key, got '%s'", first.key)
+	}
+	if keys := persisted(t, requestID); len(keys) != 2 {
+		t.Fatalf("expected both messages to be persisted, got %v", keys)
+	}
+
+	// delivering the first message keeps the second one on disk
+	forwardQueued(first)
+	stored, err := loadRequest(second.key)
+	if err != nil || string(stored.data) != "second" {
+		t.Fatalf("expected the second message to be kept, error: %v", err)
+	}
+	if state, _ := getStatus(requestID); state.Status != statusQueued || len(state.Messages) != 2 {
+		t.Errorf("unexpected status %+v", state)
+	}
+
+	forwardQueued(second)
+	if keys := persisted(t, requestID); len(keys) != 0 {
+		t.Errorf("expected the delivered messages to be removed, got %v", keys)
+	}
+	if state, _ := getStatus(requestID); state.Status != statusDelivered || len(state.Messages) != 2 {
+		t.Errorf("unexpected status %+v", state)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if strings.Join(received, ",") != "first,second" {
+		t.Errorf("unexpected deliveries %v", received)
+	}
+}
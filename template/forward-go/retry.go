@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	forwardRetries     = 0
+	forwardBackoff     time.Duration
+	forwardMaxBackoff  time.Duration
+	forwardRetryStatus = map[int]bool{
+		http.StatusTooManyRequests:    true,
+		http.StatusBadGateway:         true,
+		http.StatusServiceUnavailable: true,
+		http.StatusGatewayTimeout:     true,
+	}
+)
+
+// statusError is returned by forward when the next function replies with
+// an unexpected status
+type statusError struct {
+	code       int
+	status     string
+	retryAfter time.Duration
+}
+
+func (err *statusError) Error() string {
+	return fmt.Sprintf("bad status: %s", err.status)
+}
+
+// newStatusError creates a statusError from the response
+func newStatusError(res *http.Response) *statusError {
+	return &statusError{
+		code:       res.StatusCode,
+		status:     res.Status,
+		retryAfter: parseRetryAfter(res.Header.Get("Retry-After")),
+	}
+}
+
+// parseRetryAfter parses a Retry-After header value in seconds or as a
+// http date, 0 is returned if no valid value is provided
+func parseRetryAfter(val string) time.Duration {
+	if val == "" {
+		return 0
+	}
+	seconds, err := strconv.Atoi(val)
+	if err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	date, err := http.ParseTime(val)
+	if err != nil {
+		return 0
+	}
+	wait := date.Sub(time.Now())
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
+
+// parseStatusList parses a comma separated list of status codes
+func parseStatusList(val string) map[int]bool {
+	codes := make(map[int]bool)
+	for _, code := range strings.Split(val, ",") {
+		code = strings.TrimSpace(code)
+		if code == "" {
+			continue
+		}
+		parsed, err := strconv.Atoi(code)
+		if err != nil {
+			logger.Warn("ignoring invalid status code in forward_retry_status", "code", code)
+			continue
+		}
+		codes[parsed] = true
+	}
+	return codes
+}
+
+// retryable checks if a failed forward should be attempted again. A chain
+// error is only retried when the next function itself failed, a failure
+// further down the chain was already retried by the function before it
+func retryable(meta *requestMeta, err error) bool {
+	switch ferr := err.(type) {
+	case *statusError:
+		return forwardRetryStatus[ferr.code]
+	case *chainError:
+		return ferr.Hop == meta.Hop+1 && forwardRetryStatus[ferr.Status]
+	}
+	// connection error
+	return true
+}
+
+// backoff returns the time to wait before the next attempt, it grows
+// exponentially with the attempt and is randomized to avoid retrying in
+// lockstep. A Retry-After provided by the next function is respected
+func backoff(attempt int, err error) time.Duration {
+	wait := forwardBackoff
+	for i := 0; i < attempt && wait < forwardMaxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > forwardMaxBackoff {
+		wait = forwardMaxBackoff
+	}
+	// jitter in [wait/2, wait]
+	if wait > 1 {
+		wait = wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+	}
+	if serr, ok := err.(*statusError); ok && serr.retryAfter > wait {
+		wait = serr.retryAfter
+	}
+	return wait
+}
+
+// forwardWithRetry forwards the request data and retries as per the
+// retry policy, the number of attempts made is returned
+func forwardWithRetry(client *http.Client, url string, meta *requestMeta, data []byte) (result *forwardResponse, attempts int, err error) {
+	rlog := requestLogger(meta).With("target", url)
+	for attempt := 0; ; attempt++ {
+		attempts = attempt + 1
+		result, err = forward(client, url, meta, data)
+		if err == nil {
+			if attempt > 0 {
+				rlog.Info("forwarded request after retry", "attempt", attempt+1)
+			}
+			return
+		}
+		wait := backoff(attempt, err)
+		// no attempt is made past the deadline of the chain
+		late := !meta.Deadline.IsZero() && time.Now().Add(wait).After(meta.Deadline)
+		if attempt >= forwardRetries || !retryable(meta, err) || late {
+			rlog.Error("attempt to forward request failed", "attempt", attempt+1, "max_attempts", forwardRetries+1, "error", err)
+			return
+		}
+		rlog.Warn("attempt to forward request failed, retrying", "attempt", attempt+1, "max_attempts", forwardRetries+1, "retry_in", wait, "error", err)
+		time.Sleep(wait)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// setupRetry sets the retry policy, the returned function restores it
+func setupRetry(retries int, backoff time.Duration, maxBackoff time.Duration) func() {
+	saved := []interface{}{forwardRetries, forwardBackoff, forwardMaxBackoff}
+	forwardRetries, forwardBackoff, forwardMaxBackoff = retries, backoff, maxBackoff
+	return func() {
+		forwardRetries = saved[0].(int)
+		forwardBackoff = saved[1].(time.Duration)
+		forwardMaxBackoff = saved[2].(time.Duration)
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	meta := &requestMeta{ID: genRequestId(), Hop: 1}
+	for _, tc := range []struct {
+		err       error
+		retryable bool
+	}{
+		{fmt.Errorf("connection refused"), true},
+		{&statusError{code: http.StatusBadGateway}, true},
+		{&statusError{code: http.StatusBadRequest}, false},
+		// the next function failed
+		{&chainError{Hop: 2, Status: http.StatusServiceUnavailable}, true},
+		{&chainError{Hop: 2, Status: http.StatusInternalServerError}, false},
+		// a function further down the chain failed, it was retried already
+		{&chainError{Hop: 3, Status: http.StatusServiceUnavailable}, false},
+	} {
+		if retryable(meta, tc.err) != tc.retryable {
+			t.Errorf("expected retryable to be %v for %v", tc.retryable, tc.err)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	defer setupRetry(3, 100*time.Millisecond, time.Second)()
+	for _, tc := range []struct {
+		attempt int
+		min     time.Duration
+		max     time.Duration
+	}{
+		{0, 50 * time.Millisecond, 100 * time.Millisecond},
+		{1, 100 * time.Millisecond, 200 * time.Millisecond},
+		{2, 200 * time.Millisecond, 400 * time.Millisecond},
+		{3, 400 * time.Millisecond, 800 * time.Millisecond},
+		// the backoff is capped by forward_max_backoff
+		{4, 500 * time.Millisecond, time.Second},
+		{20, 500 * time.Millisecond, time.Second},
+	} {
+		for i := 0; i < 100; i++ {
+			if wait := backoff(tc.attempt, fmt.Errorf("connection refused")); wait < tc.min || wait > tc.max {
+				t.Errorf("expected the backoff of attempt %d in [%s, %s], got %s", tc.attempt, tc.min, tc.max, wait)
+				break
+			}
+		}
+	}
+
+	// a longer Retry-After is respected, a shorter one doesn't cut the backoff
+	if wait := backoff(0, &statusError{code: http.StatusServiceUnavailable, retryAfter: 3 * time.Second}); wait != 3*time.Second {
+		t.Errorf("expected the Retry-After to be respected, got %s", wait)
+	}
+	if wait := backoff(3, &statusError{code: http.StatusServiceUnavailable, retryAfter: time.Millisecond}); wait < 400*time.Millisecond {
+		t.Errorf("expected the backoff to be kept, got %s", wait)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	for val, expected := range map[string]time.Duration{
+		"":        0,
+		"2":       2 * time.Second,
+		"-1":      0,
+		"invalid": 0,
+		time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat): 0,
+	} {
+		if wait := parseRetryAfter(val); wait != expected {
+			t.Errorf("expected '%s' to wait %s, got %s", val, expected, wait)
+		}
+	}
+	date := time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)
+	if wait := parseRetryAfter(date); wait < 55*time.Second || wait > time.Minute {
+		t.Errorf("expected '%s' to wait about a minute, got %s", date, wait)
+	}
+}
+
+func TestForwardWithRetry(t *testing.T) {
+	defer setupRetry(3, time.Millisecond, 2*time.Millisecond)()
+	var lock sync.Mutex
+	var attempts []time.Time
+	next := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		lock.Lock()
+		attempts = append(attempts, time.Now())
+		attempt := len(attempts)
+		lock.Unlock()
+		switch attempt {
+		case 1:
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case 2:
+			w.WriteHeader(http.StatusBadGateway)
+		default:
+			w.Write([]byte("ok"))
+		}
+	}))
+	defer next.Close()
+
+	result, count, err := forwardWithRetry(&http.Client{}, next.URL, &requestMeta{ID: genRequestId()}, []byte("data"))
+	if err != nil || count != 3 || string(result.data) != "ok" {
+		t.Fatalf("expected the request to be forwarded at the third attempt, got %d attempts, error: %v", count, err)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if wait := attempts[1].Sub(attempts[0]); wait < time.Second {
+		t.Errorf("expected the Retry-After of 1s to be respected, retried after %s", wait)
+	}
+	if wait := attempts[2].Sub(attempts[1]); wait > 500*time.Millisecond {
+		t.Errorf("expected the retry to follow the backoff, retried after %s", wait)
+	}
+}
+
+func TestForwardRetriesRunOut(t *testing.T) {
+	defer setupRetry(2, time.Millisecond, time.Millisecond)()
+	for _, tc := range []struct {
+		status   int
+		attempts int
+	}{
+		{http.StatusServiceUnavailable, 3},
+		// a status that isn't retried fails at once
+		{http.StatusBadRequest, 1},
+	} {
+		count := 0
+		next := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ioutil.ReadAll(r.Body)
+			count++
+			w.WriteHeader(tc.status)
+		}))
+		_, attempts, err := forwardWithRetry(&http.Client{}, next.URL, &requestMeta{ID: genRequestId()}, []byte("data"))
+		next.Close()
+		if serr, ok := err.(*statusError); !ok || serr.code != tc.status || attempts != tc.attempts || count != tc.attempts {
+			t.Errorf("expected %d attempts failing with %d, got %d (%d received), error: %v", tc.attempts, tc.status, attempts, count, err)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	// separates the matcher and the target of a route
+	routeSeparator = "=>"
+	// target of a route that ends the chain
+	routeStop = "stop"
+)
+
+var (
+	routes []*route
+)
+
+// route forwards the output to its targets when the matcher matches
+type route struct {
+	kind    string
+	path    []string
+	value   string
+	regex   *regexp.Regexp
+	targets []*target
+}
+
+// routingEnabled checks if the next functions are chosen by the routes
+func routingEnabled() bool {
+	return len(routes) > 0
+}
+
+// parseRoutes parses the routing table, one '<matcher> => <functions>'
+// route per line where matcher is 'json:<path>=<value>', 'regex:<expr>',
+// 'content_type:<type>' or 'default' and functions is a comma separated
+// list of functions or 'stop' to end the chain. Empty lines and lines
+// starting with '#' are ignored
+func parseRoutes(val string) ([]*route, error) {
+	var parsed []*route
+	scanner := bufio.NewScanner(strings.NewReader(val))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		index := strings.LastIndex(line, routeSeparator)
+		if index < 0 {
+			return nil, fmt.Errorf("invalid route '%s', expected '<matcher> %s <function>'", line, routeSeparator)
+		}
+		r, err := parseMatcher(strings.TrimSpace(line[:index]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid route '%s', %v", line, err)
+		}
+		dest := strings.TrimSpace(line[index+len(routeSeparator):])
+		if dest == "" {
+			return nil, fmt.Errorf("invalid route '%s', no function provided", line)
+		}
+		if dest != routeStop {
+			r.targets = parseTargets(dest)
+		}
+		parsed = append(parsed, r)
+	}
+	return parsed, scanner.Err()
+}
+
+// parseMatcher parses the matcher of a route
+func parseMatcher(matcher string) (*route, error) {
+	if matcher == "default" {
+		return &route{kind: "default"}, nil
+	}
+	index := strings.Index(matcher, ":")
+	if index < 0 {
+		return nil, fmt.Errorf("unknown matcher '%s'", matcher)
+	}
+	r := &route{kind: matcher[:index]}
+	arg := matcher[index+1:]
+	switch r.kind {
+	case "json":
+		index = strings.Index(arg, "=")
+		if index < 0 {
+			return nil, fmt.Errorf("expected 'json:<path>=<value>'")
+		}
+		path := strings.TrimPrefix(strings.TrimPrefix(arg[:index], "$"), ".")
+		if path != "" {
+			r.path = strings.Split(path, ".")
+		}
+		r.value = arg[index+1:]
+	case "regex":
+		regex, err := regexp.Compile(arg)
+		if err != nil {
+			return nil, err
+		}
+		r.regex = regex
+	case "content_type":
+		r.value = strings.ToLower(strings.TrimSpace(arg))
+	default:
+		return nil, fmt.Errorf("unknown matcher '%s'", r.kind)
+	}
+	return r, nil
+}
+
+// nextTargets returns the functions the output is forwarded to, none if
+// the output ends the chain
+func nextTargets(data []byte, respType string) []*target {
+	if !routingEnabled() {
+		return forwardTargets
+	}
+
+	var doc interface{}
+	var parsed, valid bool
+	for _, r := range routes {
+		switch r.kind {
+		case "default":
+			return r.targets
+		case "regex":
+			if r.regex.Match(data) {
+				return r.targets
+			}
+		case "content_type":
+			if matchContentType(r.value, respType) {
+				return r.targets
+			}
+		case "json":
+			if !parsed {
+				valid = json.Unmarshal(data, &doc) == nil
+				parsed = true
+			}
+			if !valid {
+				continue
+			}
+			value, ok := lookupJSON(doc, r.path)
+			if ok && value == r.value {
+				return r.targets
+			}
+		}
+	}
+	// fallback to the static forward if no route matches
+	return forwardTargets
+}
+
+// matchContentType checks if the content type matches the route type
+func matchContentType(routeType string, respType string) bool {
+	mediaType, _, err := mime.ParseMediaType(respType)
+	if err != nil {
+		return false
+	}
+	if strings.HasSuffix(routeType, "/*") {
+		return strings.HasPrefix(mediaType, strings.TrimSuffix(routeType, "*"))
+	}
+	return mediaType == routeType
+}
+
+// lookupJSON returns the value at path in a json document as a string
+func lookupJSON(doc interface{}, path []string) (string, bool) {
+	for _, key := range path {
+		switch node := doc.(type) {
+		case map[string]interface{}:
+			value, ok := node[key]
+			if !ok {
+				return "", false
+			}
+			doc = value
+		case []interface{}:
+			index, err := strconv.Atoi(key)
+			if err != nil || index < 0 || index >= len(node) {
+				return "", false
+			}
+			doc = node[index]
+		default:
+			return "", false
+		}
+	}
+
+	switch value := doc.(type) {
+	case string:
+		return value, true
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(value), true
+	case nil:
+		return "null", true
+	default:
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return "", false
+		}
+		return string(encoded), true
+	}
+}
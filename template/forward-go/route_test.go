@@ -0,0 +1,125 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// targetNames returns the names of the targets, 'stop' if there are none
+func targetNames(targets []*target) string {
+	if len(targets) == 0 {
+		return routeStop
+	}
+	names := make([]string, len(targets))
+	for i, t := range targets {
+		names[i] = t.name
+	}
+	return strings.Join(names, ",")
+}
+
+func TestParseRoutes(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		table string
+		kinds []string
+		err   bool
+	}{
+		{"empty", "", nil, false},
+		{"comments", "# routes\n\n  # none yet\n", nil, false},
+		{"every matcher", "json:$.type=image => resize\nregex:^ERROR => alert\ncontent_type:image/* => thumbnail, ocr\ndefault => stop", []string{"json", "regex", "content_type", "default"}, false},
+		{"separator in matcher", "regex:=>$ => arrows", []string{"regex"}, false},
+		{"no separator", "json:$.type=image resize", nil, true},
+		{"no function", "json:$.type=image =>", nil, true},
+		{"unknown matcher", "header:X-Type=image => resize", nil, true},
+		{"no matcher argument", "json => resize", nil, true},
+		{"json without value", "json:$.type => resize", nil, true},
+		{"invalid regex", "regex:[a- => resize", nil, true},
+	} {
+		parsed, err := parseRoutes(tc.table)
+		if tc.err {
+			if err == nil {
+				t.Errorf("%s: expected the routes to be invalid", tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: failed to parse routes, error: %v", tc.name, err)
+			continue
+		}
+		if len(parsed) != len(tc.kinds) {
+			t.Errorf("%s: expected %d routes, got %d", tc.name, len(tc.kinds), len(parsed))
+			continue
+		}
+		for i, r := range parsed {
+			if r.kind != tc.kinds[i] {
+				t.Errorf("%s: expected route %d to be '%s', got '%s'", tc.name, i, tc.kinds[i], r.kind)
+			}
+		}
+	}
+
+	parsed, _ := parseRoutes("json:$.items.0.type=image => resize\ncontent_type: Image/PNG => thumbnail, ocr\ndefault => stop")
+	if strings.Join(parsed[0].path, ".") != "items.0.type" || parsed[0].value != "image" {
+		t.Errorf("unexpected json matcher %v=%s", parsed[0].path, parsed[0].value)
+	}
+	if parsed[1].value != "image/png" || targetNames(parsed[1].targets) != "thumbnail,ocr" {
+		t.Errorf("unexpected content type route %s => %s", parsed[1].value, targetNames(parsed[1].targets))
+	}
+	if parsed[2].targets != nil {
+		t.Errorf("expected the stop route to have no function, got %s", targetNames(parsed[2].targets))
+	}
+}
+
+func TestNextTargets(t *testing.T) {
+	savedRoutes, savedTargets := routes, forwardTargets
+	defer func() { routes, forwardTargets = savedRoutes, savedTargets }()
+	forwardTargets = parseTargets("static")
+
+	table := `
+json:$.type=image => resize
+json:$.items.1.ok=true => second
+json:$.size=1.5 => size
+regex:^ERROR => alert
+content_type:image/* => thumbnail, ocr
+content_type:text/csv => csv
+`
+	var err error
+	routes, err = parseRoutes(table)
+	if err != nil {
+		t.Fatalf("failed to parse routes, error: %v", err)
+	}
+	for _, tc := range []struct {
+		name     string
+		data     string
+		respType string
+		targets  string
+	}{
+		{"json string", `{"type": "image"}`, "application/json", "resize"},
+		{"json array", `{"items": [{"ok": false}, {"ok": true}]}`, "application/json", "second"},
+		{"json number", `{"size": 1.5}`, "", "size"},
+		{"json other value", `{"type": "video"}`, "application/json", "static"},
+		{"invalid json", `ERROR {"type": "image"`, "text/plain", "alert"},
+		{"content type wildcard", "png", "image/png", "thumbnail,ocr"},
+		{"content type parameters", "a,b", "text/csv; charset=utf-8", "csv"},
+		{"invalid content type", "a,b", "text/csv; charset", "static"},
+		{"no match", "hello", "text/plain", "static"},
+	} {
+		if targets := targetNames(nextTargets([]byte(tc.data), tc.respType)); targets != tc.targets {
+			t.Errorf("%s: expected '%s', got '%s'", tc.name, tc.targets, targets)
+		}
+	}
+
+	// the default route is used once no previous route matches
+	routes, _ = parseRoutes(table + "default => stop")
+	if targets := targetNames(nextTargets([]byte("hello"), "text/plain")); targets != routeStop {
+		t.Errorf("expected the default route to end the chain, got '%s'", targets)
+	}
+	if targets := targetNames(nextTargets([]byte(`{"type": "image"}`), "")); targets != "resize" {
+		t.Errorf("expected the first matching route, got '%s'", targets)
+	}
+
+	// the static forward is used without routes
+	routes = nil
+	if targets := targetNames(nextTargets([]byte(`{"type": "image"}`), "")); targets != "static" {
+		t.Errorf("expected the static forward, got '%s'", targets)
+	}
+}
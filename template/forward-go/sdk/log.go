@@ -0,0 +1,156 @@
+package sdk
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Log formats of the Logger
+const (
+	// LogText writes the message followed by the fields as key=value
+	LogText = "text"
+	// LogJSON writes a json object per line
+	LogJSON = "json"
+	// LogLogfmt writes a logfmt line
+	LogLogfmt = "logfmt"
+)
+
+// Logger writes log lines carrying the fields of the request, such as the
+// request ID and the hop, in the log format of the function
+type Logger struct {
+	format string
+	out    io.Writer
+	lock   *sync.Mutex
+	fields []interface{}
+}
+
+// NewLogger returns a Logger writing to out in format, LogText is used for
+// an unknown format
+func NewLogger(format string, out io.Writer) *Logger {
+	switch format {
+	case LogJSON, LogLogfmt:
+	default:
+		format = LogText
+	}
+	return &Logger{format: format, out: out, lock: &sync.Mutex{}}
+}
+
+// With returns a Logger adding the key value pairs to every line
+func (l *Logger) With(keyvals ...interface{}) *Logger {
+	l = l.orDefault()
+	fields := make([]interface{}, 0, len(l.fields)+len(keyvals))
+	fields = append(fields, l.fields...)
+	fields = append(fields, keyvals...)
+	return &Logger{format: l.format, out: l.out, lock: l.lock, fields: fields}
+}
+
+// Info writes an informational message with the key value pairs
+func (l *Logger) Info(msg string, keyvals ...interface{}) {
+	l.orDefault().write("info", msg, keyvals)
+}
+
+// Warn writes a warning message with the key value pairs
+func (l *Logger) Warn(msg string, keyvals ...interface{}) {
+	l.orDefault().write("warn", msg, keyvals)
+}
+
+// Error writes an error message with the key value pairs
+func (l *Logger) Error(msg string, keyvals ...interface{}) {
+	l.orDefault().write("error", msg, keyvals)
+}
+
+// Panic writes an error message with the key value pairs and panics
+func (l *Logger) Panic(msg string, keyvals ...interface{}) {
+	l.orDefault().write("error", msg, keyvals)
+	panic(msg)
+}
+
+var defaultLogger = NewLogger(LogText, os.Stderr)
+
+// orDefault allows a nil Logger to be used
+func (l *Logger) orDefault() *Logger {
+	if l == nil {
+		return defaultLogger
+	}
+	return l
+}
+
+func (l *Logger) write(level string, msg string, keyvals []interface{}) {
+	now := time.Now()
+	fields := append(append([]interface{}{}, l.fields...), keyvals...)
+	if len(fields)%2 != 0 {
+		fields = append(fields, "")
+	}
+
+	var b bytes.Buffer
+	switch l.format {
+	case LogJSON:
+		b.WriteString(`{"time":`)
+		writeJSON(&b, now.UTC().Format(time.RFC3339Nano))
+		b.WriteString(`,"level":`)
+		writeJSON(&b, level)
+		b.WriteString(`,"msg":`)
+		writeJSON(&b, msg)
+		for i := 0; i < len(fields); i += 2 {
+			b.WriteByte(',')
+			writeJSON(&b, fmt.Sprint(fields[i]))
+			b.WriteByte(':')
+			writeJSON(&b, fieldValue(fields[i+1]))
+		}
+		b.WriteString("}\n")
+	case LogLogfmt:
+		b.WriteString("time=" + now.UTC().Format(time.RFC3339Nano))
+		b.WriteString(" level=" + level)
+		b.WriteString(" msg=" + logfmtValue(msg))
+		for i := 0; i < len(fields); i += 2 {
+			b.WriteString(" " + fmt.Sprint(fields[i]) + "=" + logfmtValue(fmt.Sprint(fieldValue(fields[i+1]))))
+		}
+		b.WriteByte('\n')
+	default:
+		b.WriteString(now.Format("2006/01/02 15:04:05 ") + msg)
+		for i := 0; i < len(fields); i += 2 {
+			b.WriteString(" " + fmt.Sprint(fields[i]) + "=" + logfmtValue(fmt.Sprint(fieldValue(fields[i+1]))))
+		}
+		b.WriteByte('\n')
+	}
+
+	l.lock.Lock()
+	l.out.Write(b.Bytes())
+	l.lock.Unlock()
+}
+
+// fieldValue returns the value of a field as written in a log line
+func fieldValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case error:
+		return v.Error()
+	case time.Duration:
+		return v.String()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return value
+}
+
+func writeJSON(b *bytes.Buffer, value interface{}) {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		encoded, _ = json.Marshal(fmt.Sprint(value))
+	}
+	b.Write(encoded)
+}
+
+// logfmtValue quotes a value if needed
+func logfmtValue(value string) string {
+	if value == "" || strings.ContainsAny(value, " =\"\t\r\n") {
+		return strconv.Quote(value)
+	}
+	return value
+}
@@ -0,0 +1,67 @@
+// Package sdk defines the request and the response of a forward-go
+// function implementing HandleRequest instead of Handle
+package sdk
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+)
+
+// Request is a request received by a function of the chain
+type Request struct {
+	// ID of the request, shared by every function of the chain
+	ID string
+	// Hop is the position of the function in the chain, 0 for the head
+	Hop int
+	// Origin is the address of the caller of the chain
+	Origin string
+	// Method of the http request
+	Method string
+	// Header of the http request, including the caller headers propagated
+	// along the chain
+	Header http.Header
+	// Query of the http request
+	Query url.Values
+	// Body is the data received from the caller or the previous function
+	Body []byte
+	// TraceParent is the W3C trace context of the handler span, to trace
+	// the calls made by the handler
+	TraceParent string
+	// Identity are the verified claims of the caller of the chain, nil if
+	// the chain doesn't authenticate its callers
+	Identity map[string]interface{}
+	// Log is the logger of the request, its lines carry the request ID,
+	// the hop and the function name
+	Log *Logger
+
+	ctx context.Context
+}
+
+// Context returns the context of the request, it is canceled when the
+// caller goes away or the function times out
+func (req *Request) Context() context.Context {
+	if req.ctx == nil {
+		return context.Background()
+	}
+	return req.ctx
+}
+
+// WithContext returns a copy of the request with its context changed to ctx
+func (req *Request) WithContext(ctx context.Context) *Request {
+	copied := *req
+	copied.ctx = ctx
+	return &copied
+}
+
+// Response is the output of a function
+type Response struct {
+	// Body is the output, forwarded to the next function if any
+	Body []byte
+	// StatusCode of the response, 200 if not set
+	StatusCode int
+	// Header of the response
+	Header http.Header
+	// ContentType of the body, the function content_type if not set
+	ContentType string
+}
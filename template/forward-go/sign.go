@@ -0,0 +1,290 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// directory of the secrets mounted by OpenFaaS
+	secretsDIR = "/var/openfaas/secrets"
+	// header carrying the time a forwarded request was signed at, in unix
+	// seconds
+	timestampHeader = "X-Forward-Timestamp"
+	// header carrying the signature of a forwarded request
+	signatureHeader = "X-Forward-Signature"
+	// header carrying the random nonce of a signed request, every attempt
+	// to forward a request is signed with its own nonce
+	nonceHeader = "X-Forward-Nonce"
+	// header carrying the host and path a signed request was sent to
+	targetHeader = "X-Forward-Target"
+	// form field carrying the signed digest of the data of a forwarded
+	// request, it follows the data so that the data can be streamed
+	digestFormName = "digest"
+)
+
+var (
+	// forwardSecret is the secret shared by the functions of the chain to
+	// sign the forwarded requests, signing is disabled when empty
+	forwardSecret []byte
+	// signatureMaxAge is the time a signed request is accepted for
+	signatureMaxAge time.Duration
+
+	// nonces already accepted, kept until they are stale
+	seenNonces    = make(map[string]time.Time)
+	seenLock      sync.Mutex
+	lastSeenPrune time.Time
+)
+
+// parseForwardSecret reads the shared secret, the value is the name of an
+// OpenFaaS secret or the path of a file
+func parseForwardSecret(val string) []byte {
+	if val == "" {
+		return nil
+	}
+	path := secretPath(val)
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		logger.Panic("Cannot read forward_secret", "path", path, "error", err)
+	}
+	secret := []byte(strings.TrimSpace(string(content)))
+	if len(secret) == 0 {
+		logger.Panic("Empty forward_secret", "path", path)
+	}
+	return secret
+}
+
+// secretPath returns the path of a secret, the value is the name of an
+// OpenFaaS secret or the path of a file
+func secretPath(val string) string {
+	if filepath.IsAbs(val) {
+		return val
+	}
+	return filepath.Join(secretsDIR, val)
+}
+
+// signingEnabled checks if the forwarded requests are signed
+func signingEnabled() bool {
+	return len(forwardSecret) > 0
+}
+
+// signedContent returns the signed content of a forwarded request, its
+// target and the chain metadata along with the propagated headers it lists
+func signedContent(header http.Header) []byte {
+	fields := []string{
+		header.Get(timestampHeader),
+		header.Get(nonceHeader),
+		header.Get(targetHeader),
+		header.Get(requestIDHeader),
+		header.Get(hopHeader),
+		header.Get(originHeader),
+		header.Get(asyncHeader),
+		header.Get(forwardCallbackHeader),
+		header.Get(budgetHeader),
+		header.Get(identityHeader),
+		header.Get(failureHeader),
+		header.Get(headersHeader),
+	}
+	for _, name := range parseHeaderList(header.Get(headersHeader)) {
+		fields = append(fields, name+": "+strings.Join(header[name], ", "))
+	}
+	return []byte(strings.Join(fields, "\n"))
+}
+
+// signature returns the signature of the headers of a forwarded request
+func signature(header http.Header) string {
+	mac := hmac.New(sha256.New, forwardSecret)
+	mac.Write(signedContent(header))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// digestSignature returns the signature of the SHA-256 digest of the data
+// of a forwarded request, it is bound to the signature of the headers
+func digestSignature(sig string, sum []byte) string {
+	mac := hmac.New(sha256.New, forwardSecret)
+	mac.Write([]byte(sig + "\n" + hex.EncodeToString(sum)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signRequest signs the headers of a request to the next function,
+// writeMeta must have been called on the request. The data is signed once
+// it is sent by newForwardRequest
+func signRequest(req *http.Request) {
+	if !signingEnabled() {
+		return
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	nonce := randomHex(16)
+	req.Header.Set(timestampHeader, timestamp)
+	req.Header.Set(nonceHeader, nonce)
+	req.Header.Set(targetHeader, req.Host+urlPath(req.URL.Path))
+	req.Header.Set(signatureHeader, signature(req.Header))
+}
+
+// verifyRequest checks the signature of the headers of a request forwarded
+// by the previous function, a nonce is only accepted once and within
+// signatureMaxAge of the time the request was signed. The data is checked
+// once read with verifyDigest
+func verifyRequest(r *http.Request) error {
+	requestID := r.Header.Get(requestIDHeader)
+	timestamp := r.Header.Get(timestampHeader)
+	nonce := r.Header.Get(nonceHeader)
+	sig := r.Header.Get(signatureHeader)
+	if requestID == "" || timestamp == "" || nonce == "" || sig == "" {
+		return errors.New("request is not signed")
+	}
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.New("invalid signature timestamp")
+	}
+	age := time.Since(time.Unix(seconds, 0))
+	if age > signatureMaxAge || age < -signatureMaxAge {
+		return errors.New("signature is stale")
+	}
+	expected := signature(r.Header)
+	if !hmac.Equal([]byte(sig), []byte(expected)) {
+		return errors.New("invalid signature")
+	}
+	if !addressesFunction(r, r.Header.Get(targetHeader)) {
+		return errors.New("request is signed for another target")
+	}
+
+	seenLock.Lock()
+	defer seenLock.Unlock()
+	now := time.Now()
+	if now.Sub(lastSeenPrune) > signatureMaxAge {
+		for seen, at := range seenNonces {
+			if now.Sub(at) > 2*signatureMaxAge {
+				delete(seenNonces, seen)
+			}
+		}
+		lastSeenPrune = now
+	}
+	if _, ok := seenNonces[nonce]; ok {
+		return errors.New("nonce already used")
+	}
+	seenNonces[nonce] = now
+	return nil
+}
+
+// urlPath returns the path of a URL, '/' if empty
+func urlPath(path string) string {
+	if path == "" {
+		return "/"
+	}
+	return path
+}
+
+// addressesFunction checks that a forwarded request reached the target it
+// was signed for, either directly on the same host and path or through the
+// gateway on /function/<name> or /async-function/<name>, in which case the
+// name must match function_name when set
+func addressesFunction(r *http.Request, target string) bool {
+	i := strings.Index(target, "/")
+	if i < 0 {
+		return false
+	}
+	host, path := target[:i], target[i:]
+	for _, route := range []string{"/function/", "/async-function/"} {
+		if !strings.HasPrefix(path, route) {
+			continue
+		}
+		name, rest := path[len(route):], "/"
+		if j := strings.Index(name, "/"); j >= 0 {
+			name, rest = name[:j], name[j:]
+		}
+		if configured := os.Getenv("function_name"); configured != "" && strings.SplitN(name, ".", 2)[0] != configured {
+			return false
+		}
+		return rest == urlPath(r.URL.Path)
+	}
+	return host == r.Host && path == urlPath(r.URL.Path)
+}
+
+// rejectUnsigned replies 401 to a forwarded request that doesn't carry a
+// valid signature, true is returned if the request is rejected
+func rejectUnsigned(w http.ResponseWriter, r *http.Request) bool {
+	if !signingEnabled() || inputType != "FILE" {
+		return false
+	}
+	err := verifyRequest(r)
+	if err == nil {
+		return false
+	}
+	meta := readMeta(r, "")
+	meta.Identity = nil
+	requestLogger(meta).Warn("rejecting forwarded request", "remote", r.RemoteAddr, "error", err)
+	writeError(w, meta, http.StatusUnauthorized, err.Error())
+	return true
+}
+
+// verifyDigest checks the signed digest of the data of a forwarded request
+func verifyDigest(r *http.Request, sum []byte, signed string) error {
+	if signed == "" {
+		return errors.New("data is not signed")
+	}
+	expected := digestSignature(r.Header.Get(signatureHeader), sum)
+	if !hmac.Equal([]byte(signed), []byte(expected)) {
+		return errors.New("invalid data signature")
+	}
+	return nil
+}
+
+// digestReader reads the data of a streamed forwarded request, the end of
+// the data is only reported once its signed digest is verified
+type digestReader struct {
+	r        *http.Request
+	data     io.Reader
+	form     *multipart.Reader
+	hash     hash.Hash
+	verified bool
+	err      error
+}
+
+// newDigestReader returns a reader of the data part of the form
+func newDigestReader(r *http.Request, form *multipart.Reader, data io.Reader) *digestReader {
+	return &digestReader{r: r, data: data, form: form, hash: sha256.New()}
+}
+
+func (dr *digestReader) Read(p []byte) (int, error) {
+	n, err := dr.data.Read(p)
+	dr.hash.Write(p[:n])
+	if err == io.EOF {
+		if !dr.verified {
+			dr.err, dr.verified = dr.verify(), true
+		}
+		if dr.err != nil {
+			return n, dr.err
+		}
+	}
+	return n, err
+}
+
+// verify reads the signed digest following the data
+func (dr *digestReader) verify() error {
+	part, err := dr.form.NextPart()
+	if err == io.EOF || (err == nil && part.FormName() != digestFormName) {
+		return errors.New("data is not signed")
+	}
+	if err != nil {
+		return err
+	}
+	signed, err := ioutil.ReadAll(io.LimitReader(part, 1024))
+	if err != nil {
+		return err
+	}
+	return verifyDigest(dr.r, dr.hash.Sum(nil), string(signed))
+}
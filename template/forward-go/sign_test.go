@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setupSigning enables signing, the returned function restores the config
+func setupSigning() func() {
+	savedSecret, savedMaxAge := forwardSecret, signatureMaxAge
+	forwardSecret, signatureMaxAge = []byte("secret"), time.Minute
+	return func() {
+		forwardSecret, signatureMaxAge = savedSecret, savedMaxAge
+	}
+}
+
+// signedRequest returns a request to the next function signed as per meta
+func signedRequest(meta *requestMeta) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	writeMeta(req, meta)
+	signRequest(req)
+	return req
+}
+
+func TestVerifyRequest(t *testing.T) {
+	defer setupSigning()()
+	meta := &requestMeta{
+		ID:          genRequestId(),
+		CallbackURL: "http://receiver:8080/",
+		Deadline:    time.Now().Add(time.Minute),
+		Header:      http.Header{"X-Tenant": []string{"acme"}},
+		Identity:    map[string]interface{}{"sub": "alice"},
+	}
+
+	// a retry signed within the same second is a new request
+	first, retry := signedRequest(meta), signedRequest(meta)
+	if err := verifyRequest(first); err != nil {
+		t.Fatalf("failed to verify request, error: %v", err)
+	}
+	if err := verifyRequest(retry); err != nil {
+		t.Errorf("failed to verify retried request, error: %v", err)
+	}
+
+	// a replayed request is rejected
+	if err := verifyRequest(first); err == nil {
+		t.Error("expected a replayed request to be rejected")
+	}
+
+	for name, val := range map[string]string{
+		hopHeader:             "5",
+		forwardCallbackHeader: "http://attacker:8080/",
+		budgetHeader:          "3600000",
+		headersHeader:         "Authorization, X-Tenant",
+		"X-Tenant":            "other",
+	} {
+		tampered := signedRequest(meta)
+		tampered.Header.Set(name, val)
+		if err := verifyRequest(tampered); err == nil {
+			t.Errorf("expected a request with a tampered %s to be rejected", name)
+		}
+	}
+
+	stale := signedRequest(meta)
+	timestamp := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	stale.Header.Set(timestampHeader, timestamp)
+	stale.Header.Set(signatureHeader, signature(stale.Header))
+	if err := verifyRequest(stale); err == nil {
+		t.Error("expected a stale request to be rejected")
+	}
+
+	if err := verifyRequest(httptest.NewRequest(http.MethodPost, "/", nil)); err == nil {
+		t.Error("expected an unsigned request to be rejected")
+	}
+}
+
+func TestSignedTarget(t *testing.T) {
+	defer setupSigning()()
+	defer os.Unsetenv("function_name")
+	meta := &requestMeta{ID: genRequestId()}
+
+	// received returns the request to the url as received by the function
+	// on the host and path
+	received := func(url string, host string, path string) *http.Request {
+		req, _ := http.NewRequest(http.MethodPost, url, nil)
+		writeMeta(req, meta)
+		signRequest(req)
+		r := httptest.NewRequest(http.MethodPost, path, nil)
+		r.Host = host
+		r.Header = req.Header
+		return r
+	}
+	for _, tc := range []struct {
+		name         string
+		functionName string
+		url          string
+		host         string
+		path         string
+		verify       bool
+	}{
+		{"direct", "", "http://next:8080", "next:8080", "/", true},
+		{"direct path", "", "http://next:8080/resize", "next:8080", "/resize", true},
+		{"other host", "", "http://next:8080", "other:8080", "/", false},
+		{"other path", "", "http://next:8080/resize", "next:8080", "/", false},
+		{"gateway", "", "http://gateway:8080/function/next", "next.openfaas-fn:8080", "/", true},
+		{"gateway async", "", "http://gateway:8080/async-function/next", "next.openfaas-fn:8080", "/", true},
+		{"gateway path", "", "http://gateway:8080/function/next/resize", "next:8080", "/", false},
+		{"function name", "next", "http://gateway:8080/function/next.openfaas-fn", "next:8080", "/", true},
+		{"other function name", "other", "http://gateway:8080/function/next", "other:8080", "/", false},
+	} {
+		os.Setenv("function_name", tc.functionName)
+		err := verifyRequest(received(tc.url, tc.host, tc.path))
+		if tc.verify && err != nil {
+			t.Errorf("%s: failed to verify request, error: %v", tc.name, err)
+		}
+		if !tc.verify && err == nil {
+			t.Errorf("%s: expected the request signed for another target to be rejected", tc.name)
+		}
+	}
+
+	// the target can't be changed
+	r := received("http://next:8080", "next:8080", "/")
+	r.Header.Set(targetHeader, "other:8080/")
+	r.Host = "other:8080"
+	if err := verifyRequest(r); err == nil {
+		t.Error("expected a request with a tampered target to be rejected")
+	}
+}
+
+// receivedData reads the data of a forwarded request as a buffered and as
+// a streamed request
+func receivedData(t *testing.T, req *http.Request) (buffered error, streamed error) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		t.Fatalf("failed to read request, error: %v", err)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+	r.Header = req.Header
+	if err := r.ParseMultipartForm(1 << 20); err != nil {
+		t.Fatalf("failed to parse request, error: %v", err)
+	}
+	file, _, err := r.FormFile(fileFormName)
+	if err != nil {
+		t.Fatalf("no data in request, error: %v", err)
+	}
+	data, _ := ioutil.ReadAll(file)
+	sum := sha256.Sum256(data)
+	buffered = verifyDigest(r, sum[:], r.PostFormValue(digestFormName))
+
+	r = httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+	r.Header = req.Header
+	in, _, err := streamInput(r)
+	if err != nil {
+		t.Fatalf("failed to stream request, error: %v", err)
+	}
+	_, streamed = ioutil.ReadAll(in)
+	return
+}
+
+func TestSignedData(t *testing.T) {
+	defer setupSigning()()
+	saved := inputType
+	inputType = "FILE"
+	defer func() { inputType = saved }()
+	meta := &requestMeta{ID: genRequestId()}
+
+	req, err := newForwardRequest("http://next:8080/", meta, strings.NewReader("payload"))
+	if err != nil {
+		t.Fatalf("failed to create request, error: %v", err)
+	}
+	if buffered, streamed := receivedData(t, req); buffered != nil || streamed != nil {
+		t.Errorf("failed to verify data, errors: %v, %v", buffered, streamed)
+	}
+
+	// the data is replaced on the way
+	req, _ = newForwardRequest("http://next:8080/", meta, strings.NewReader("payload"))
+	body, _ := ioutil.ReadAll(req.Body)
+	req.Body = ioutil.NopCloser(bytes.NewReader(bytes.Replace(body, []byte("payload"), []byte("tampered"), 1)))
+	if buffered, streamed := receivedData(t, req); buffered == nil || streamed == nil {
+		t.Error("expected replaced data to be rejected")
+	}
+
+	// the digest is stripped
+	secret := forwardSecret
+	forwardSecret = nil
+	req, _ = newForwardRequest("http://next:8080/", meta, strings.NewReader("payload"))
+	forwardSecret = secret
+	signRequest(req)
+	if buffered, streamed := receivedData(t, req); buffered == nil || streamed == nil {
+		t.Error("expected unsigned data to be rejected")
+	}
+}
+
+func TestForwardedIdentity(t *testing.T) {
+	saved := inputType
+	inputType = "FILE"
+	defer func() { inputType = saved }()
+	meta := &requestMeta{ID: genRequestId(), Identity: map[string]interface{}{"sub": "alice"}}
+
+	// a forged identity isn't trusted without signing
+	forged := httptest.NewRequest(http.MethodPost, "/", nil)
+	forged.Header.Set(identityHeader, encodeIdentity(meta.Identity))
+	if identity := readMeta(forged, "").Identity; identity != nil {
+		t.Errorf("expected the unsigned identity to be ignored, got %v", identity)
+	}
+	if req := signedRequest(meta); req.Header.Get(identityHeader) != "" {
+		t.Error("expected the identity not to be forwarded unsigned")
+	}
+
+	defer setupSigning()()
+	req := signedRequest(meta)
+	if err := verifyRequest(req); err != nil {
+		t.Fatalf("failed to verify request, error: %v", err)
+	}
+	if identity := readMeta(req, "").Identity; identity["sub"] != "alice" {
+		t.Errorf("unexpected identity %v", identity)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// the request is waiting in the queue
+	statusQueued = "queued"
+	// the request is being forwarded to the next functions
+	statusForwarding = "forwarding"
+	// the request is accepted by the next functions
+	statusDelivered = "delivered"
+	// the request is sent to the dead letter
+	statusDeadLettered = "dead-lettered"
+	// the request failed and is lost
+	statusFailed = "failed"
+)
+
+var (
+	statusRetention time.Duration
+	statusLock      sync.Mutex
+	// states of the messages by message key
+	statusStore = make(map[string]*requestStatus)
+	// message keys by request ID
+	statusKeys = make(map[string]map[string]bool)
+	// statusOrder orders the states from the least advanced, the state of
+	// a request received several times is the least advanced of its
+	// messages
+	statusOrder = []string{statusQueued, statusForwarding, statusFailed, statusDeadLettered, statusDelivered}
+)
+
+// requestStatus is the state of an async request in the function
+type requestStatus struct {
+	RequestID string    `json:"request_id"`
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	Updated   time.Time `json:"updated"`
+	// Messages are the states of each message when the function received
+	// the request several times, along the branches of the chain
+	Messages []requestStatus `json:"messages,omitempty"`
+}
+
+// setStatus records the state of a message of an async request
+func setStatus(key string, requestID string, status string, err error) {
+	state := &requestStatus{
+		RequestID: requestID,
+		Status:    status,
+		Updated:   time.Now(),
+	}
+	if err != nil {
+		state.Error = err.Error()
+	}
+	statusLock.Lock()
+	statusStore[key] = state
+	if statusKeys[requestID] == nil {
+		statusKeys[requestID] = make(map[string]bool)
+	}
+	statusKeys[requestID][key] = true
+	statusLock.Unlock()
+}
+
+// statusRank returns the position of a state in statusOrder
+func statusRank(status string) int {
+	for i, s := range statusOrder {
+		if s == status {
+			return i
+		}
+	}
+	return len(statusOrder)
+}
+
+// getStatus returns the state of an async request, the states of its
+// messages are listed when it was received several times
+func getStatus(requestID string) (requestStatus, bool) {
+	statusLock.Lock()
+	defer statusLock.Unlock()
+	keys := statusKeys[requestID]
+	if len(keys) == 0 {
+		return requestStatus{}, false
+	}
+	var messages []requestStatus
+	for key := range keys {
+		messages = append(messages, *statusStore[key])
+	}
+	if len(messages) == 1 {
+		return messages[0], true
+	}
+	sort.Slice(messages, func(i, j int) bool {
+		return messages[i].Updated.Before(messages[j].Updated)
+	})
+	merged := messages[0]
+	for _, state := range messages[1:] {
+		if statusRank(state.Status) < statusRank(merged.Status) {
+			merged.Status, merged.Error = state.Status, state.Error
+		}
+		merged.Updated = state.Updated
+	}
+	merged.Messages = messages
+	return merged, true
+}
+
+// forgetStatus removes the state of a message that was not accepted
+func forgetStatus(key string) {
+	statusLock.Lock()
+	forgetStatusLocked(key)
+	statusLock.Unlock()
+}
+
+// forgetStatusLocked removes the state of a message, statusLock must be
+// held
+func forgetStatusLocked(key string) {
+	state, ok := statusStore[key]
+	if !ok {
+		return
+	}
+	delete(statusStore, key)
+	delete(statusKeys[state.RequestID], key)
+	if len(statusKeys[state.RequestID]) == 0 {
+		delete(statusKeys, state.RequestID)
+	}
+}
+
+// statusPruner forgets the requests that reached a final state longer than
+// the retention ago
+func statusPruner() {
+	for range time.Tick(time.Minute) {
+		expiry := time.Now().Add(-statusRetention)
+		statusLock.Lock()
+		for key, state := range statusStore {
+			final := state.Status != statusQueued && state.Status != statusForwarding
+			if final && state.Updated.Before(expiry) {
+				forgetStatusLocked(key)
+			}
+		}
+		statusLock.Unlock()
+	}
+}
+
+// acceptedBody is the reply to an async request
+type acceptedBody struct {
+	RequestID string `json:"request_id"`
+	Status    string `json:"status"`
+}
+
+// writeAccepted replies to a request accepted to be forwarded in async
+func writeAccepted(w http.ResponseWriter, requestID string) {
+	body, _ := json.Marshal(&acceptedBody{RequestID: requestID, Status: statusQueued})
+	w.Header().Set(requestIDHeader, requestID)
+	writeResult(w, &forwardResponse{data: body, respType: "application/json", status: http.StatusAccepted})
+}
+
+// handle async request status request on /_/status/<request-id>
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		requestID := strings.TrimPrefix(r.URL.Path, "/_/status/")
+		state, ok := getStatus(requestID)
+		if requestID == "" || !ok {
+			http.Error(w, "unknown request '"+requestID+"'", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(&state)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
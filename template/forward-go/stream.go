@@ -0,0 +1,252 @@
+package main
+
+import (
+	"fmt"
+	"handler/sdk"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+var (
+	// handleStream is set when the function implements HandleStream
+	handleStream func(req *sdk.Request, in io.Reader, out io.Writer) error
+)
+
+// streamable checks if the request can be streamed through the function,
+// the output is buffered when it is stored, routed, sent to multiple
+// functions or may be forwarded more than once, and the input is buffered
+// when it may be forwarded on handler error
+func streamable() bool {
+	return handleStream != nil && !async && !routingEnabled() && len(forwardTargets) <= 1 && forwardRetries == 0 && onError == "abort"
+}
+
+// runHandleStream runs the handler and records its duration and span. The
+// handler context ends at the exec timeout but the handler isn't abandoned
+// as it owns the input and the output
+func runHandleStream(req *sdk.Request, in io.Reader, out io.Writer, span *span) (err error) {
+	parent := req.Context()
+	req, cancel := withExecTimeout(req)
+	defer cancel()
+	start := time.Now()
+	defer func() {
+		handlerDuration.observe("", time.Since(start).Seconds())
+		if err != nil && req.Context().Err() != nil {
+			err = contextError(parent, err)
+		}
+		span.finish(err)
+		if err != nil {
+			handlerErrors.inc("")
+		}
+	}()
+	defer recoverHandler(req, &err)
+	return handleStream(req, in, out)
+}
+
+// eofReader records when the input is fully read
+type eofReader struct {
+	r    io.Reader
+	done bool
+}
+
+func (er *eofReader) Read(p []byte) (int, error) {
+	n, err := er.r.Read(p)
+	if err == io.EOF {
+		er.done = true
+	}
+	return n, err
+}
+
+// streamWriter writes the output of the function to the caller. The server
+// discards the unread input once the response is sent, so the output is
+// spooled to a temporary file until the input is fully read
+type streamWriter struct {
+	w       http.ResponseWriter
+	in      *eofReader
+	spool   *os.File
+	written bool
+}
+
+func (sw *streamWriter) Write(p []byte) (int, error) {
+	if !sw.in.done {
+		if sw.spool == nil {
+			spool, err := ioutil.TempFile("", "stream")
+			if err != nil {
+				return 0, err
+			}
+			sw.spool = spool
+		}
+		return sw.spool.Write(p)
+	}
+	err := sw.flush()
+	if err != nil {
+		return 0, err
+	}
+	return sw.w.Write(p)
+}
+
+// flush writes the chain result headers and the spooled output
+func (sw *streamWriter) flush() error {
+	if !sw.written {
+		sw.written = true
+		sw.w.Header().Set("Content-Type", contentType)
+		sw.w.Header().Set(statusHeader, strconv.Itoa(http.StatusOK))
+		sw.w.WriteHeader(http.StatusOK)
+	}
+	if sw.spool == nil {
+		return nil
+	}
+	defer sw.discard()
+	_, err := sw.spool.Seek(0, io.SeekStart)
+	if err == nil {
+		_, err = io.Copy(sw.w, sw.spool)
+	}
+	return err
+}
+
+// discard removes the spooled output
+func (sw *streamWriter) discard() {
+	if sw.spool != nil {
+		sw.spool.Close()
+		os.Remove(sw.spool.Name())
+		sw.spool = nil
+	}
+}
+
+// streamInput returns the input of the request without buffering it
+func streamInput(r *http.Request) (io.Reader, *requestMeta, error) {
+	if inputType == "POST" {
+		meta := newMeta(r, genRequestId())
+		requestLogger(meta).Info("received fresh request, generated request ID")
+		return r.Body, meta, nil
+	}
+
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, nil, err
+	}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil, nil, fmt.Errorf("no '%s' file in forwarded data", fileFormName)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if part.FormName() == fileFormName {
+			meta := readMeta(r, part.FileName())
+			requestLogger(meta).Info("received streamed request")
+			if signingEnabled() {
+				return newDigestReader(r, reader, part), meta, nil
+			}
+			return part, meta, nil
+		}
+	}
+}
+
+// reqHandleStream streams the request through the function to the caller
+// or to the next function
+func reqHandleStream(w http.ResponseWriter, r *http.Request) {
+
+	in, meta, err := streamInput(r)
+	if err != nil {
+		logger.Error("failed to parse forwarded data", "error", err)
+		writeError(w, readMeta(r, ""), http.StatusBadRequest, fmt.Sprintf("failed to parse forwarded data, error: %v", err))
+		return
+	}
+	meta.ContentType = contentType
+	rlog := requestLogger(meta)
+
+	// the request is dropped once the chain caller gave up
+	if rejectExhausted(w, meta) {
+		return
+	}
+
+	req, span, cancel := newHandlerRequest(r, meta, nil)
+	defer cancel()
+
+	// end of chain of an async request, the output is streamed to the
+	// callback as the caller doesn't wait for it
+	if (!forwardEnable || len(forwardTargets) == 0) && needsCallback(meta) {
+		pr, pw := io.Pipe()
+		go func() {
+			pw.CloseWithError(runHandleStream(req, in, pw, span))
+		}()
+		err = postCallback(meta, pr, contentType, http.StatusOK, "")
+		pr.Close()
+		if err != nil {
+			rlog.Error("failed to stream result to callback", "callback", meta.CallbackURL, "error", err)
+			writeError(w, meta, http.StatusBadGateway, fmt.Sprintf("failed to stream result to callback, error: %v", err))
+			return
+		}
+		rlog.Info("sent result to callback", "callback", meta.CallbackURL)
+		writeResult(w, &forwardResponse{respType: contentType, status: http.StatusOK})
+		return
+	}
+
+	// end of chain, the output is streamed to the caller
+	if !forwardEnable || len(forwardTargets) == 0 {
+		sw := &streamWriter{w: w, in: &eofReader{r: in}}
+		err = runHandleStream(req, sw.in, sw, span)
+		switch {
+		case err != nil && !sw.written:
+			sw.discard()
+			rlog.Error("Failed to handle request", "error", err)
+			writeError(w, meta, handlerErrorStatus(err), fmt.Sprintf("Failed to handle request: %v", err))
+		case err != nil:
+			rlog.Error("Failed to handle request after writing the response", "error", err)
+		default:
+			err = sw.flush()
+			if err != nil {
+				rlog.Error("failed to write the result", "error", err)
+			}
+		}
+		return
+	}
+
+	// the output is streamed to the next function while it is produced
+	pr, pw := io.Pipe()
+	handled := make(chan error, 1)
+	go func() {
+		herr := runHandleStream(req, in, pw, span)
+		handled <- herr
+		pw.CloseWithError(herr)
+	}()
+
+	// unblock the handler if the next function doesn't read the output
+	defer pr.Close()
+
+	client := forwardClient()
+	res, err := forwardStream(client, forwardTargets[0].addr, meta, pr)
+	if err != nil {
+		// the forward fails as well when the handler fails, the handler
+		// error is known by then
+		select {
+		case herr := <-handled:
+			if herr != nil {
+				rlog.Error("Failed to handle request", "error", herr)
+				writeError(w, meta, handlerErrorStatus(herr), fmt.Sprintf("Failed to handle request: %v", herr))
+				return
+			}
+		default:
+		}
+		rlog.Error("failed to forward request", "target", forwardTargets[0].name, "error", err)
+		writeChainError(w, forwardError(meta, forwardTargets[0], err))
+		return
+	}
+	defer res.Body.Close()
+
+	// the result of the last function is streamed back as is
+	if respType := res.Header.Get("Content-Type"); respType != "" {
+		w.Header().Set("Content-Type", respType)
+	}
+	w.Header().Set(statusHeader, strconv.Itoa(res.StatusCode))
+	w.WriteHeader(res.StatusCode)
+	_, err = io.Copy(w, res.Body)
+	if err != nil {
+		rlog.Error("failed to stream the result", "error", err)
+	}
+}
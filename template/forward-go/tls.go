@@ -0,0 +1,227 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// serverTLS is the TLS config of the server, nil to serve plain http
+	serverTLS *tls.Config
+	// forwardTransport is the transport of the requests to the next
+	// functions, nil for the default transport
+	forwardTransport *http.Transport
+	// externalTransport is the transport of the requests to the callbacks
+	// and the dead letter URLs, it doesn't present the client certificate.
+	// nil for the default transport
+	externalTransport *http.Transport
+	// forwardScheme is the scheme a function name is reached on in the
+	// direct forward mode
+	forwardScheme = "http"
+	// certReloadInterval is the interval the certificate files are checked
+	// for changes at
+	certReloadInterval time.Duration
+	// certificates reloaded on change
+	reloaders []*certReloader
+)
+
+// certReloader holds a certificate loaded from files, which is reloaded
+// once the files change
+type certReloader struct {
+	certFile string
+	keyFile  string
+	lock     sync.RWMutex
+	cert     *tls.Certificate
+	modTime  time.Time
+}
+
+// newCertReloader loads the certificate from the files
+func newCertReloader(certFile string, keyFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := c.reload(); err != nil {
+		return nil, err
+	}
+	reloaders = append(reloaders, c)
+	return c, nil
+}
+
+// reload loads the certificate again if the files changed since it was
+// loaded, true is returned if the certificate was replaced
+func (c *certReloader) reload() (bool, error) {
+	modTime, err := latestModTime(c.certFile, c.keyFile)
+	if err != nil {
+		return false, err
+	}
+	c.lock.RLock()
+	changed := !modTime.Equal(c.modTime)
+	c.lock.RUnlock()
+	if !changed {
+		return false, nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return false, err
+	}
+	c.lock.Lock()
+	c.cert, c.modTime = &cert, modTime
+	c.lock.Unlock()
+	return true, nil
+}
+
+func (c *certReloader) certificate() *tls.Certificate {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.cert
+}
+
+// getCertificate returns the certificate of the server
+func (c *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.certificate(), nil
+}
+
+// getClientCertificate returns the certificate of the forwards
+func (c *certReloader) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return c.certificate(), nil
+}
+
+// latestModTime returns the latest modification time of the files
+func latestModTime(paths ...string) (time.Time, error) {
+	var latest time.Time
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// certWatcher reloads the certificates once their files change, the
+// current certificate is kept while the new files can't be loaded
+func certWatcher() {
+	for range time.Tick(certReloadInterval) {
+		for _, c := range reloaders {
+			changed, err := c.reload()
+			if err != nil {
+				logger.Error("failed to reload certificate", "cert", c.certFile, "key", c.keyFile, "error", err)
+			} else if changed {
+				logger.Info("reloaded certificate", "cert", c.certFile, "key", c.keyFile)
+			}
+		}
+	}
+}
+
+// loadCAPool reads a bundle of PEM certificates, the system certificates
+// are included when requested
+func loadCAPool(path string, system bool) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	if system {
+		if systemPool, err := x509.SystemCertPool(); err == nil {
+			pool = systemPool
+		}
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if !pool.AppendCertsFromPEM(content) {
+		return nil, fmt.Errorf("no certificate found in %s", path)
+	}
+	return pool, nil
+}
+
+// parseTLS reads the TLS config of the server and of the forwards
+func parseTLS() {
+	certReloadInterval = parseIntOrDurationValue(os.Getenv("tls_reload_interval"), 30*time.Second)
+
+	certFile, keyFile := os.Getenv("tls_cert_file"), os.Getenv("tls_key_file")
+	if certFile != "" || keyFile != "" {
+		reloader, err := newCertReloader(certFile, keyFile)
+		if err != nil {
+			logger.Panic("Cannot load tls certificate", "cert", certFile, "key", keyFile, "error", err)
+		}
+		serverTLS = &tls.Config{GetCertificate: reloader.getCertificate}
+		if path := os.Getenv("tls_client_ca_file"); path != "" {
+			pool, err := loadCAPool(path, false)
+			if err != nil {
+				logger.Panic("Cannot read tls_client_ca_file", "path", path, "error", err)
+			}
+			serverTLS.ClientCAs = pool
+			serverTLS.ClientAuth = tls.RequireAndVerifyClientCert
+			logger.Info("Client CA provided, callers must present a client certificate")
+		}
+		logger.Info("TLS certificate provided, serving https")
+	}
+
+	if strings.ToUpper(os.Getenv("forward_tls")) == "TRUE" {
+		forwardScheme = "https"
+	}
+	var pool *x509.CertPool
+	if path := os.Getenv("forward_ca_file"); path != "" {
+		var err error
+		pool, err = loadCAPool(path, true)
+		if err != nil {
+			logger.Panic("Cannot read forward_ca_file", "path", path, "error", err)
+		}
+		externalTransport = newTransport(&tls.Config{RootCAs: pool})
+		forwardTransport = externalTransport
+	}
+	certFile, keyFile = os.Getenv("forward_cert_file"), os.Getenv("forward_key_file")
+	if certFile != "" || keyFile != "" {
+		reloader, err := newCertReloader(certFile, keyFile)
+		if err != nil {
+			logger.Panic("Cannot load forward certificate", "cert", certFile, "key", keyFile, "error", err)
+		}
+		forwardTransport = newTransport(&tls.Config{
+			RootCAs:              pool,
+			GetClientCertificate: reloader.getClientCertificate,
+		})
+	}
+}
+
+// newTransport creates a transport with the settings of the default
+// transport and the TLS config
+func newTransport(config *tls.Config) *http.Transport {
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+			DualStack: true,
+		}).DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		TLSClientConfig:       config,
+	}
+}
+
+// forwardClient returns the client of the requests to the next functions
+func forwardClient() *http.Client {
+	if forwardTransport == nil {
+		return &http.Client{}
+	}
+	return &http.Client{Transport: forwardTransport}
+}
+
+// externalClient returns the client of the requests to the callbacks and
+// the dead letter URLs, which are outside of the chain and aren't sent the
+// client certificate
+func externalClient() *http.Client {
+	if externalTransport == nil {
+		return &http.Client{}
+	}
+	return &http.Client{Transport: externalTransport}
+}
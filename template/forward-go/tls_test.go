@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// testCA is a certificate authority issuing the certificates of a test
+type testCA struct {
+	cert   *x509.Certificate
+	key    *ecdsa.PrivateKey
+	serial int64
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key, error: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create ca certificate, error: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse ca certificate, error: %v", err)
+	}
+	return &testCA{cert: cert, key: key, serial: 1}
+}
+
+// pem returns the PEM encoded certificate of the CA
+func (ca *testCA) pem() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})
+}
+
+// issue returns a PEM encoded leaf certificate and key valid for the
+// loopback address, both as a server and as a client
+func (ca *testCA) issue(t *testing.T, name string) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key, error: %v", err)
+	}
+	ca.serial++
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(ca.serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("failed to create certificate, error: %v", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to encode key, error: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+// writeFile writes the content to a file of the directory
+func writeFile(t *testing.T, dir string, name string, content []byte) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, content, 0600); err != nil {
+		t.Fatalf("failed to write %s, error: %v", path, err)
+	}
+	return path
+}
+
+// setupTLS sets the env, the returned function restores the TLS config
+func setupTLS(env map[string]string) func() {
+	saved := []interface{}{serverTLS, forwardTransport, externalTransport, forwardScheme, certReloadInterval, reloaders}
+	for key, val := range env {
+		os.Setenv(key, val)
+	}
+	return func() {
+		for key := range env {
+			os.Unsetenv(key)
+		}
+		serverTLS = saved[0].(*tls.Config)
+		forwardTransport = saved[1].(*http.Transport)
+		externalTransport = saved[2].(*http.Transport)
+		forwardScheme = saved[3].(string)
+		certReloadInterval = saved[4].(time.Duration)
+		reloaders = saved[5].([]*certReloader)
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatalf("failed to create directory, error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	ca := newTestCA(t)
+	serverCert, serverKey := ca.issue(t, "server")
+	clientCert, clientKey := ca.issue(t, "client")
+	caFile := writeFile(t, dir, "ca.pem", ca.pem())
+	defer setupTLS(map[string]string{
+		"tls_cert_file":      writeFile(t, dir, "server.pem", serverCert),
+		"tls_key_file":       writeFile(t, dir, "server.key", serverKey),
+		"tls_client_ca_file": caFile,
+		"forward_cert_file":  writeFile(t, dir, "client.pem", clientCert),
+		"forward_key_file":   writeFile(t, dir, "client.key", clientKey),
+		"forward_ca_file":    caFile,
+		"forward_tls":        "true",
+	})()
+	parseTLS()
+	if serverTLS == nil || forwardTransport == nil || forwardScheme != "https" {
+		t.Fatal("expected TLS to be configured for the server and the forwards")
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen, error: %v", err)
+	}
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+		}),
+		// the rejected handshake is expected
+		ErrorLog: log.New(ioutil.Discard, "", 0),
+	}
+	go server.Serve(tls.NewListener(listener, serverTLS))
+	defer server.Close()
+	url := "https://" + listener.Addr().String() + "/"
+
+	// the forwards present the client certificate
+	res, err := forwardClient().Get(url)
+	if err != nil {
+		t.Fatalf("failed to reach the server with a client certificate, error: %v", err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if string(body) != "client" {
+		t.Errorf("unexpected peer '%s'", body)
+	}
+
+	// a caller without a client certificate is rejected
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	anonymous := &http.Client{Transport: newTransport(&tls.Config{RootCAs: pool})}
+	if res, err := anonymous.Get(url); err == nil {
+		res.Body.Close()
+		t.Error("expected a caller without a client certificate to be rejected")
+	}
+
+	// the callbacks verify the server but don't present the certificate
+	listener, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen, error: %v", err)
+	}
+	receiver := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(strconv.Itoa(len(r.TLS.PeerCertificates))))
+		}),
+	}
+	receiverTLS := serverTLS.Clone()
+	receiverTLS.ClientAuth = tls.RequestClientCert
+	go receiver.Serve(tls.NewListener(listener, receiverTLS))
+	defer receiver.Close()
+	res, err = externalClient().Get("https://" + listener.Addr().String() + "/")
+	if err != nil {
+		t.Fatalf("failed to reach the callback receiver, error: %v", err)
+	}
+	body, _ = ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if string(body) != "0" {
+		t.Errorf("expected no client certificate, got %s", body)
+	}
+}
+
+func TestCertReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatalf("failed to create directory, error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	defer setupTLS(nil)()
+	ca := newTestCA(t)
+	cert, key := ca.issue(t, "first")
+	certFile := writeFile(t, dir, "cert.pem", cert)
+	keyFile := writeFile(t, dir, "key.pem", key)
+
+	reloader, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("failed to load certificate, error: %v", err)
+	}
+	first := reloader.certificate()
+	if changed, err := reloader.reload(); changed || err != nil {
+		t.Errorf("expected unchanged files not to be reloaded, error: %v", err)
+	}
+
+	// the files are rewritten with a new certificate
+	cert, key = ca.issue(t, "second")
+	writeFile(t, dir, "cert.pem", cert)
+	writeFile(t, dir, "key.pem", key)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	os.Chtimes(keyFile, later, later)
+	if changed, err := reloader.reload(); !changed || err != nil {
+		t.Fatalf("expected the rewritten certificate to be reloaded, error: %v", err)
+	}
+	second := reloader.certificate()
+	if bytes.Equal(first.Certificate[0], second.Certificate[0]) {
+		t.Fatal("expected the certificate to be replaced")
+	}
+	leaf, err := x509.ParseCertificate(second.Certificate[0])
+	if err != nil || leaf.Subject.CommonName != "second" {
+		t.Errorf("unexpected reloaded certificate, error: %v", err)
+	}
+
+	// an invalid rewrite keeps the current certificate
+	writeFile(t, dir, "cert.pem", []byte("invalid"))
+	later = later.Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	if _, err := reloader.reload(); err == nil {
+		t.Error("expected an invalid certificate to fail to load")
+	}
+	if reloader.certificate() != second {
+		t.Error("expected the current certificate to be kept")
+	}
+}
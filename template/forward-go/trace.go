@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// header carrying the W3C trace context
+	traceParentHeader = "traceparent"
+	// header carrying the vendor specific W3C trace state
+	traceStateHeader = "tracestate"
+
+	// OTLP span kinds
+	spanKindServer = 2
+	spanKindClient = 3
+
+	// number of spans exported at once
+	spanBatchSize = 100
+)
+
+var (
+	// traceEndpoint is the OTLP/HTTP endpoint spans are exported to, spans
+	// are only propagated when none is configured
+	traceEndpoint string
+	// traceServiceName is the name of the function in the exported spans
+	traceServiceName string
+	// spans waiting to be exported
+	spanQueue = make(chan *span, 1000)
+)
+
+// span is a timed operation of a trace
+type span struct {
+	name     string
+	kind     int
+	traceID  string
+	spanID   string
+	parentID string
+	sampled  bool
+	start    time.Time
+	end      time.Time
+	attrs    map[string]string
+	err      error
+}
+
+// randomHex returns n random bytes hex encoded
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// isHex checks if val is a lower case hex string of n characters that
+// isn't all zeros
+func isHex(val string, n int) bool {
+	if len(val) != n || strings.Trim(val, "0") == "" {
+		return false
+	}
+	for _, c := range val {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// parseTraceParent parses a W3C traceparent header value
+func parseTraceParent(val string) (traceID string, spanID string, sampled bool, ok bool) {
+	parts := strings.Split(strings.TrimSpace(val), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[3]) != 2 {
+		return "", "", false, false
+	}
+	if parts[0] == "00" && len(parts) != 4 {
+		return "", "", false, false
+	}
+	if !isHex(parts[1], 32) || !isHex(parts[2], 16) {
+		return "", "", false, false
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil {
+		return "", "", false, false
+	}
+	return parts[1], parts[2], flags&1 == 1, true
+}
+
+// startSpan starts a span as a child of the trace context of the request,
+// a new trace is started if the request has none
+func startSpan(meta *requestMeta, name string, kind int) *span {
+	s := &span{
+		name:   name,
+		kind:   kind,
+		spanID: randomHex(8),
+		start:  time.Now(),
+		attrs: map[string]string{
+			"faas.request_id": meta.ID,
+			"faas.hop":        strconv.Itoa(meta.Hop),
+		},
+	}
+	traceID, parentID, sampled, ok := parseTraceParent(meta.TraceParent)
+	if ok {
+		s.traceID, s.parentID, s.sampled = traceID, parentID, sampled
+	} else {
+		s.traceID = randomHex(16)
+		s.sampled = traceEndpoint != ""
+	}
+	return s
+}
+
+// traceParent returns the traceparent header value of the span
+func (s *span) traceParent() string {
+	flags := "00"
+	if s.sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", s.traceID, s.spanID, flags)
+}
+
+// setAttr sets an attribute of the span
+func (s *span) setAttr(key string, value string) {
+	s.attrs[key] = value
+}
+
+// finish ends the span and queues it for export
+func (s *span) finish(err error) {
+	s.end = time.Now()
+	s.err = err
+	if traceEndpoint == "" || !s.sampled {
+		return
+	}
+	select {
+	case spanQueue <- s:
+	default:
+		logger.Warn("dropping span, export queue is full", "span", s.name, "trace_id", s.traceID)
+	}
+}
+
+// otlpValue, otlpAttribute and otlpSpan are the OTLP/HTTP json encoding
+// of the spans
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+// encodeSpans encodes spans as an OTLP/HTTP json export request
+func encodeSpans(spans []*span) ([]byte, error) {
+	encoded := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		o := otlpSpan{
+			TraceID:           s.traceID,
+			SpanID:            s.spanID,
+			ParentSpanID:      s.parentID,
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		}
+		keys := make([]string, 0, len(s.attrs))
+		for key := range s.attrs {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			o.Attributes = append(o.Attributes, otlpAttribute{Key: key, Value: otlpValue{StringValue: s.attrs[key]}})
+		}
+		if s.err != nil {
+			// STATUS_CODE_ERROR
+			o.Status = otlpStatus{Code: 2, Message: s.err.Error()}
+		}
+		encoded = append(encoded, o)
+	}
+	request := map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": []otlpAttribute{
+						{Key: "service.name", Value: otlpValue{StringValue: traceServiceName}},
+					},
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]string{"name": "faas-forward"},
+						"spans": encoded,
+					},
+				},
+			},
+		},
+	}
+	return json.Marshal(request)
+}
+
+// exportSpans sends spans to the OTLP/HTTP endpoint
+func exportSpans(spans []*span) error {
+	body, err := encodeSpans(spans)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	res, err := client.Post(traceEndpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return newStatusError(res)
+	}
+	return nil
+}
+
+// spanExporter exports the finished spans in batches
+func spanExporter() {
+	ticker := time.NewTicker(2 * time.Second)
+	defer ticker.Stop()
+	var batch []*span
+	for {
+		select {
+		case s := <-spanQueue:
+			batch = append(batch, s)
+			if len(batch) < spanBatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		err := exportSpans(batch)
+		if err != nil {
+			logger.Error("failed to export spans", "endpoint", traceEndpoint, "spans", len(batch), "error", err)
+		}
+		batch = nil
+	}
+}
+
+// parseTraceEndpoint returns the OTLP/HTTP traces endpoint, a base
+// endpoint gets the '/v1/traces' path
+func parseTraceEndpoint() string {
+	if val := os.Getenv("otlp_traces_endpoint"); val != "" {
+		return val
+	}
+	val := os.Getenv("otlp_endpoint")
+	if val == "" {
+		val = os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+	}
+	if val == "" {
+		return ""
+	}
+	return strings.TrimSuffix(val, "/") + "/v1/traces"
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// collector is an OTLP/HTTP stand-in keeping the exported spans
+type collector struct {
+	lock  sync.Mutex
+	spans map[string]otlpSpan
+}
+
+func newCollector() (*collector, *httptest.Server) {
+	c := &collector{spans: make(map[string]otlpSpan)}
+	return c, httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans []otlpSpan `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		for _, resource := range request.ResourceSpans {
+			for _, scope := range resource.ScopeSpans {
+				for _, s := range scope.Spans {
+					c.spans[s.Name] = s
+				}
+			}
+		}
+	}))
+}
+
+// exportQueued exports the n next spans of the span queue
+func exportQueued(t *testing.T, n int) {
+	var batch []*span
+	for len(batch) < n {
+		select {
+		case s := <-spanQueue:
+			batch = append(batch, s)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected %d spans, got %d", n, len(batch))
+		}
+	}
+	if err := exportSpans(batch); err != nil {
+		t.Fatalf("failed to export spans, error: %v", err)
+	}
+}
+
+func TestParseTraceParent(t *testing.T) {
+	traceID, spanID, sampled, ok := parseTraceParent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if !ok || traceID != "4bf92f3577b34da6a3ce929d0e0e4736" || spanID != "00f067aa0ba902b7" || !sampled {
+		t.Errorf("unexpected trace context %s %s %v %v", traceID, spanID, sampled, ok)
+	}
+	for _, val := range []string{
+		"",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+	} {
+		if _, _, _, ok := parseTraceParent(val); ok {
+			t.Errorf("expected '%s' to be invalid", val)
+		}
+	}
+}
+
+func TestForwardSpans(t *testing.T) {
+	c, endpoint := newCollector()
+	defer endpoint.Close()
+	saved := traceEndpoint
+	traceEndpoint = endpoint.URL
+	defer func() { traceEndpoint = saved }()
+
+	received := make(chan string, 1)
+	next := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		received <- r.Header.Get(traceParentHeader)
+		w.Write([]byte("ok"))
+	}))
+	defer next.Close()
+
+	// the caller of the function is traced
+	traceID, callerID := "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"
+	meta := &requestMeta{ID: genRequestId(), TraceParent: "00-" + traceID + "-" + callerID + "-01"}
+	handle := startSpan(meta, "handle", spanKindServer)
+	meta.TraceParent = handle.traceParent()
+
+	res, err := forwardStream(&http.Client{}, next.URL, meta, strings.NewReader("data"))
+	if err != nil {
+		t.Fatalf("failed to forward, error: %v", err)
+	}
+	res.Body.Close()
+	handle.finish(nil)
+	exportQueued(t, 2)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	handleSpan, forwardSpan := c.spans["handle"], c.spans["forward"]
+	if handleSpan.TraceID != traceID || handleSpan.ParentSpanID != callerID || handleSpan.Kind != spanKindServer {
+		t.Errorf("handle span is not a child of the caller %+v", handleSpan)
+	}
+	if forwardSpan.TraceID != traceID || forwardSpan.ParentSpanID != handleSpan.SpanID || forwardSpan.Kind != spanKindClient {
+		t.Errorf("forward span is not a child of the handle span %+v", forwardSpan)
+	}
+	// the next function is a child of the forward span
+	expected := "00-" + traceID + "-" + forwardSpan.SpanID + "-01"
+	if traceParent := <-received; traceParent != expected {
+		t.Errorf("next function received traceparent '%s', expected '%s'", traceParent, expected)
+	}
+}
+
+func TestNewTraceIsNotSampledWithoutEndpoint(t *testing.T) {
+	saved := traceEndpoint
+	traceEndpoint = ""
+	defer func() { traceEndpoint = saved }()
+
+	s := startSpan(&requestMeta{ID: genRequestId()}, "handle", spanKindServer)
+	if s.sampled || s.parentID != "" || !strings.HasSuffix(s.traceParent(), "-00") {
+		t.Errorf("unexpected span %s", s.traceParent())
+	}
+	s.finish(nil)
+	select {
+	case <-spanQueue:
+		t.Error("expected the span not to be queued for export")
+	default:
+	}
+}